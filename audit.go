@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// auditSize is the number of audit records kept in memory for /audit.
+const auditSize = 500
+
+// AuditRecord describes external commands issued on behalf of an API client.
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	User     string    `json:"user"`
+	Remote   string    `json:"remote_addr"`
+	Target   string    `json:"target"`
+	Commands []string  `json:"commands"`
+}
+
+var auditLog struct {
+	sync.Mutex
+	records []AuditRecord
+}
+
+// requestUser returns who a request was made by: the basic auth user, or the
+// X-Remote-User header set by an authenticating reverse proxy.
+func requestUser(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok {
+		return user
+	}
+	return r.Header.Get("X-Remote-User")
+}
+
+// audit logs the commands sent for target and keeps them for /audit.
+func audit(r *http.Request, target string, cmds []string) {
+	rec := AuditRecord{
+		Time:     time.Now(),
+		User:     requestUser(r),
+		Remote:   r.RemoteAddr,
+		Target:   target,
+		Commands: cmds,
+	}
+	log.Printf("audit: user=%q remote=%s target=%q commands=%q", rec.User, rec.Remote, rec.Target, rec.Commands)
+
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	auditLog.records = append(auditLog.records, rec)
+	if len(auditLog.records) > auditSize {
+		auditLog.records = auditLog.records[len(auditLog.records)-auditSize:]
+	}
+}
+
+func getAudit(w http.ResponseWriter, r *http.Request) {
+	auditLog.Lock()
+	records := make([]AuditRecord, len(auditLog.records))
+	copy(records, auditLog.records)
+	auditLog.Unlock()
+
+	writeJSON(w, r, records)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// bulkBatchSize is the number of external commands written to the socket at a
+// time by POST /bulk.
+const bulkBatchSize = 100
+
+// bulkRequest is the body accepted by POST /bulk.
+type bulkRequest struct {
+	// Action is one of acknowledge, downtime, recheck, comment, enable or
+	// disable.
+	Action string `json:"action"`
+	// Table is hosts or services.
+	Table string `json:"table"`
+	// Filter uses the same expressions as the filter parameter of the
+	// collection endpoints.
+	Filter []string `json:"filter"`
+	DryRun bool     `json:"dry_run"`
+
+	Author     string `json:"author"`
+	Comment    string `json:"comment"`
+	Sticky     bool   `json:"sticky"`
+	Notify     bool   `json:"notify"`
+	Persistent bool   `json:"persistent"`
+
+	StartTime int64 `json:"start_time"`
+	EndTime   int64 `json:"end_time"`
+	Fixed     bool  `json:"fixed"`
+	Duration  int   `json:"duration"`
+
+	// Feature is what enable and disable switch: checks, notifications,
+	// event_handler or flap_detection.
+	Feature string `json:"feature"`
+}
+
+// BulkResult is the outcome of a bulk action for one host or service.
+type BulkResult struct {
+	HostName           string   `json:"host_name"`
+	ServiceDescription string   `json:"service_description,omitempty"`
+	Commands           []string `json:"commands,omitempty"`
+	Status             string   `json:"status"`
+	Error              string   `json:"error,omitempty"`
+}
+
+// BulkResponse is returned by POST /bulk.
+type BulkResponse struct {
+	DryRun  bool         `json:"dry_run"`
+	Results []BulkResult `json:"results"`
+}
+
+// validate checks req and fills in defaults for the times and author.
+func (req *bulkRequest) validate(r *http.Request) error {
+	if req.Table != "hosts" && req.Table != "services" {
+		return errors.New("table must be hosts or services")
+	}
+	var err error
+	if req.Author, err = commandAuthor(r, req.Author); err != nil {
+		return err
+	}
+	if err := checkComment(req.Comment); err != nil {
+		return err
+	}
+
+	switch req.Action {
+	case "acknowledge", "comment":
+		if req.Comment == "" {
+			return fmt.Errorf("%s requires a comment", req.Action)
+		}
+	case "downtime":
+		if req.Comment == "" {
+			return errors.New("downtime requires a comment")
+		}
+		if req.StartTime == 0 {
+			req.StartTime = time.Now().Unix()
+		}
+		if req.EndTime <= req.StartTime {
+			return errors.New("downtime requires an end_time after start_time")
+		}
+		if !req.Fixed && req.Duration <= 0 {
+			return errors.New("flexible downtime requires a duration")
+		}
+	case "recheck":
+	case "enable", "disable":
+		if _, err := req.patch(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown action %q", req.Action)
+	}
+	return nil
+}
+
+// patch converts an enable or disable action into the patch PATCH on hosts
+// and services accepts.
+func (req *bulkRequest) patch() (objectPatch, error) {
+	var p objectPatch
+	enabled := req.Action == "enable"
+
+	switch req.Feature {
+	case "checks":
+		p.ChecksEnabled = &enabled
+	case "notifications":
+		p.NotificationsEnabled = &enabled
+	case "event_handler":
+		p.EventHandlerEnabled = &enabled
+	case "flap_detection":
+		p.FlapDetectionEnabled = &enabled
+	default:
+		return p, fmt.Errorf("unknown feature %q", req.Feature)
+	}
+	return p, nil
+}
+
+// boolArg formats b as the 0/1 argument external commands expect.
+func boolArg(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// hostCommands returns the commands req needs for h, or a reason to skip it.
+func (req *bulkRequest) hostCommands(h *Host) ([]string, string) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	switch req.Action {
+	case "acknowledge":
+		if h.State == 0 {
+			return nil, "host is up"
+		}
+		if h.Acknowledged {
+			return nil, "already acknowledged"
+		}
+		sticky := "0"
+		if req.Sticky {
+			sticky = "2"
+		}
+		return []string{command("ACKNOWLEDGE_HOST_PROBLEM", h.Name, sticky, boolArg(req.Notify), boolArg(req.Persistent), req.Author, req.Comment)}, ""
+	case "downtime":
+		return []string{command("SCHEDULE_HOST_DOWNTIME", h.Name,
+			strconv.FormatInt(req.StartTime, 10), strconv.FormatInt(req.EndTime, 10),
+			boolArg(req.Fixed), "0", strconv.Itoa(req.Duration), req.Author, req.Comment)}, ""
+	case "recheck":
+		return []string{command("SCHEDULE_FORCED_HOST_CHECK", h.Name, now)}, ""
+	case "comment":
+		return []string{command("ADD_HOST_COMMENT", h.Name, boolArg(req.Persistent), req.Author, req.Comment)}, ""
+	}
+
+	p, _ := req.patch()
+	cmds := hostPatchCommands(h, p)
+	if len(cmds) == 0 {
+		return nil, "already " + req.Action + "d"
+	}
+	return cmds, ""
+}
+
+// serviceCommands returns the commands req needs for s, or a reason to skip
+// it.
+func (req *bulkRequest) serviceCommands(s *Service) ([]string, string) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	switch req.Action {
+	case "acknowledge":
+		if s.State == 0 {
+			return nil, "service is ok"
+		}
+		if s.Acknowledged {
+			return nil, "already acknowledged"
+		}
+		sticky := "0"
+		if req.Sticky {
+			sticky = "2"
+		}
+		return []string{command("ACKNOWLEDGE_SVC_PROBLEM", s.HostName, s.Description, sticky, boolArg(req.Notify), boolArg(req.Persistent), req.Author, req.Comment)}, ""
+	case "downtime":
+		return []string{command("SCHEDULE_SVC_DOWNTIME", s.HostName, s.Description,
+			strconv.FormatInt(req.StartTime, 10), strconv.FormatInt(req.EndTime, 10),
+			boolArg(req.Fixed), "0", strconv.Itoa(req.Duration), req.Author, req.Comment)}, ""
+	case "recheck":
+		return []string{command("SCHEDULE_FORCED_SVC_CHECK", s.HostName, s.Description, now)}, ""
+	case "comment":
+		return []string{command("ADD_SVC_COMMENT", s.HostName, s.Description, boolArg(req.Persistent), req.Author, req.Comment)}, ""
+	}
+
+	p, _ := req.patch()
+	cmds := servicePatchCommands(s, p)
+	if len(cmds) == 0 {
+		return nil, "already " + req.Action + "d"
+	}
+	return cmds, ""
+}
+
+// confirmation returns what to wait for to know req took effect on the
+// object in res, given the Unix time its commands were sent.
+func (req *bulkRequest) confirmation(res BulkResult, sentAt int64) confirmation {
+	since := strconv.FormatInt(sentAt, 10)
+
+	switch req.Action {
+	case "downtime":
+		return confirmation{table: "downtimes", filters: []string{
+			"host_name = " + res.HostName,
+			"service_description = " + res.ServiceDescription,
+			"author = " + req.Author,
+			"start_time = " + strconv.FormatInt(req.StartTime, 10),
+			"end_time = " + strconv.FormatInt(req.EndTime, 10),
+		}}
+	case "comment":
+		return confirmation{table: "comments", filters: []string{
+			"host_name = " + res.HostName,
+			"service_description = " + res.ServiceDescription,
+			"author = " + req.Author,
+			"entry_time >= " + since,
+		}}
+	}
+
+	var conds []string
+	switch req.Action {
+	case "acknowledge":
+		conds = []string{"acknowledged = 1"}
+	case "recheck":
+		conds = []string{"last_check >= " + since}
+	default:
+		p, _ := req.patch()
+		conds = p.conditions()
+	}
+	if req.Table == "hosts" {
+		return hostConfirmation(res.HostName, conds...)
+	}
+	return serviceConfirmation(res.HostName, res.ServiceDescription, conds...)
+}
+
+// targets resolves the Livestatus filter headers and returns one result per
+// matching object with the commands it needs.
+func (req *bulkRequest) targets(filters string) ([]BulkResult, error) {
+	var results []BulkResult
+	if req.Table == "hosts" {
+		hosts, err := queryHosts(filters)
+		if err != nil {
+			return nil, err
+		}
+		for i := range hosts {
+			cmds, skip := req.hostCommands(&hosts[i])
+			results = append(results, BulkResult{HostName: hosts[i].Name, Commands: cmds, Error: skip})
+		}
+	} else {
+		services, err := queryServices(filters)
+		if err != nil {
+			return nil, err
+		}
+		for i := range services {
+			cmds, skip := req.serviceCommands(&services[i])
+			results = append(results, BulkResult{HostName: services[i].HostName, ServiceDescription: services[i].Description, Commands: cmds, Error: skip})
+		}
+	}
+	return results, nil
+}
+
+func postBulk(w http.ResponseWriter, r *http.Request) {
+	var req bulkRequest
+
+	if err := decodeBody(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := req.validate(r); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Filter) == 0 {
+		writeError(w, http.StatusBadRequest, "a filter is required")
+		return
+	}
+	filters, err := parseFilters(req.Table, req.Filter)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	wait, err := parseWait(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	results, err := req.targets(filters)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var cmds []string
+	for i := range results {
+		switch {
+		case results[i].Error != "":
+			results[i].Status = "skipped"
+		case req.DryRun:
+			results[i].Status = "pending"
+		default:
+			cmds = append(cmds, results[i].Commands...)
+		}
+	}
+
+	if len(cmds) > 0 {
+		sentAt := time.Now().Unix()
+		sent, err := sendCommandBatches(cmds, bulkBatchSize)
+		if sent > 0 {
+			audit(r, "bulk/"+req.Table, cmds[:sent])
+		}
+
+		n := 0
+		for i := range results {
+			if results[i].Status != "" {
+				continue
+			}
+			n += len(results[i].Commands)
+			if n <= sent {
+				results[i].Status = "sent"
+			} else {
+				results[i].Status = "failed"
+				results[i].Error = err.Error()
+			}
+		}
+
+		if wait > 0 {
+			deadline := time.Now().Add(wait)
+			for i := range results {
+				if results[i].Status != "sent" {
+					continue
+				}
+				ok, err := req.confirmation(results[i], sentAt).wait(deadline)
+				if err != nil {
+					writeError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				if ok {
+					results[i].Status = "confirmed"
+				}
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, r, BulkResponse{DryRun: req.DryRun, Results: results})
+}
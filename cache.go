@@ -0,0 +1,295 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheTables are the tables kept in memory when -cache.refresh-interval is
+// set.
+var cacheTables = []string{"comments", "downtimes", "hosts", "services"}
+
+// cachedTable is one table's rows as read from Livestatus at one point in
+// time. It is replaced, not modified, on refresh.
+type cachedTable struct {
+	taken time.Time
+	rows  []interface{}
+	// fields holds the JSON fields of each row, for filtering.
+	fields []map[string]interface{}
+	// index maps each row's key to its position in rows.
+	index map[string]int
+}
+
+// objectCache serves reads of cacheTables from memory, refreshing them in
+// the background. Objects the API sends commands for are read from
+// Livestatus until the next refresh has picked up their new state.
+type objectCache struct {
+	mu     sync.RWMutex
+	tables map[string]*cachedTable
+	// stale holds, by table, the keys of objects invalidated by commands and
+	// when. The empty key invalidates the whole table.
+	stale map[string]map[string]time.Time
+	// wake triggers a refresh of stale tables ahead of the next interval.
+	wake chan struct{}
+}
+
+var stateCache = &objectCache{
+	tables: make(map[string]*cachedTable),
+	stale:  make(map[string]map[string]time.Time),
+	wake:   make(chan struct{}, 1),
+}
+
+func commentKey(c *Comment) string {
+	return strconv.Itoa(c.ID)
+}
+
+func downtimeKey(d *Downtime) string {
+	return strconv.Itoa(d.ID)
+}
+
+// queryTable reads the rows of table matching the given Livestatus filter
+// headers, along with their keys.
+func queryTable(table, filters string) ([]interface{}, []string, error) {
+	var rows []interface{}
+	var keys []string
+
+	switch table {
+	case "comments":
+		comments, err := queryComments(filters)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range comments {
+			rows = append(rows, comments[i])
+			keys = append(keys, commentKey(&comments[i]))
+		}
+	case "contacts":
+		contacts, err := queryContacts(filters)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range contacts {
+			rows = append(rows, contacts[i])
+			keys = append(keys, contacts[i].Name)
+		}
+	case "downtimes":
+		downtimes, err := queryDowntimes(filters)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range downtimes {
+			rows = append(rows, downtimes[i])
+			keys = append(keys, downtimeKey(&downtimes[i]))
+		}
+	case "hosts":
+		hosts, err := queryHosts(filters)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range hosts {
+			rows = append(rows, hosts[i])
+			keys = append(keys, hostKey(&hosts[i]))
+		}
+	case "services":
+		services, err := queryServices(filters)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range services {
+			rows = append(rows, services[i])
+			keys = append(keys, serviceKey(&services[i]))
+		}
+	}
+	return rows, keys, nil
+}
+
+func (c *objectCache) run() {
+	ticker := time.NewTicker(*cacheRefresh)
+	defer ticker.Stop()
+
+	tables := cacheTables
+	for {
+		for _, table := range tables {
+			if err := c.refresh(table); err != nil {
+				log.Printf("cache: refreshing %s: %v", table, err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+			tables = cacheTables
+		case <-c.wake:
+			tables = c.staleTables()
+		}
+	}
+}
+
+// refresh replaces table's rows with a fresh copy from Livestatus.
+func (c *objectCache) refresh(table string) error {
+	start := time.Now()
+	rows, keys, err := queryTable(table, "")
+	if err != nil {
+		return err
+	}
+
+	t := &cachedTable{
+		taken:  start,
+		rows:   rows,
+		fields: make([]map[string]interface{}, len(rows)),
+		index:  make(map[string]int, len(rows)),
+	}
+	for i, row := range rows {
+		t.fields[i] = fieldsOf(row)
+		t.index[keys[i]] = i
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tables[table] = t
+	// Objects invalidated while the table was being read may not be up to
+	// date yet.
+	for key, at := range c.stale[table] {
+		if at.Before(start) {
+			delete(c.stale[table], key)
+		}
+	}
+	return nil
+}
+
+func (c *objectCache) staleTables() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var tables []string
+	for _, table := range cacheTables {
+		if len(c.stale[table]) > 0 {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// invalidate marks the objects cmds act on as stale and schedules a refresh.
+func (c *objectCache) invalidate(cmds []string) {
+	if *cacheRefresh <= 0 || len(cmds) == 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	for _, cmd := range cmds {
+		for table, key := range commandObjects(cmd) {
+			if c.stale[table] == nil {
+				c.stale[table] = make(map[string]time.Time)
+			}
+			c.stale[table][key] = now
+		}
+	}
+	c.mu.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// commandObjects returns the cache keys, by table, of the objects an external
+// command may change. Downtimes and comments are added under IDs that are
+// not known in advance, so commands touching them invalidate the whole
+// table. Program-wide commands change no cached object.
+func commandObjects(cmd string) map[string]string {
+	parts := strings.Split(cmd, ";")
+	name := parts[0]
+	objs := make(map[string]string)
+
+	switch {
+	case len(parts) > 2 && strings.Contains(name, "SVC_"):
+		objs["services"] = parts[1] + ";" + parts[2]
+	case len(parts) > 1 && strings.Contains(name, "HOST_"):
+		objs["hosts"] = parts[1]
+	}
+	if strings.Contains(name, "DOWNTIME") {
+		objs["downtimes"] = ""
+	}
+	if strings.Contains(name, "COMMENT") || strings.Contains(name, "ACKNOWLEDGE") {
+		objs["comments"] = ""
+	}
+	return objs
+}
+
+// cached returns the copy of table that r may be served from, or nil if r
+// must go to Livestatus. An empty key asks for the whole table.
+func (c *objectCache) cached(r *http.Request, table, key string) *cachedTable {
+	if *cacheRefresh <= 0 || strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		return nil
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	stale := c.stale[table]
+	if key == "" && len(stale) > 0 {
+		return nil
+	}
+	if _, ok := stale[key]; ok {
+		return nil
+	}
+	if _, ok := stale[""]; ok {
+		return nil
+	}
+	return c.tables[table]
+}
+
+// list returns the cached rows of table matching r's filter parameter. It
+// returns false if r must go to Livestatus, which includes invalid filters
+// so the caller reports them.
+func (c *objectCache) list(w http.ResponseWriter, r *http.Request, table string) ([]interface{}, bool) {
+	t := c.cached(r, table, "")
+	if t == nil {
+		return nil, false
+	}
+	fs, err := parseFieldFilters(table, r.URL.Query()["filter"])
+	if err != nil {
+		return nil, false
+	}
+	var custom map[string]string
+	if table == "hosts" || table == "services" {
+		if custom, err = parseCustomFilters(r.URL.Query()); err != nil {
+			return nil, false
+		}
+	}
+
+	var rows []interface{}
+	for i, row := range t.rows {
+		if matchAll(fs, t.fields[i]) && matchCustom(custom, t.fields[i]) {
+			rows = append(rows, row)
+		}
+	}
+	writeCacheAge(w, t)
+	return rows, true
+}
+
+// get returns the cached row of table with the given key. It returns false if
+// r must go to Livestatus, which includes objects created since the last
+// refresh.
+func (c *objectCache) get(w http.ResponseWriter, r *http.Request, table, key string) (interface{}, bool) {
+	t := c.cached(r, table, key)
+	if t == nil {
+		return nil, false
+	}
+	i, ok := t.index[key]
+	if !ok {
+		return nil, false
+	}
+	writeCacheAge(w, t)
+	return t.rows[i], true
+}
+
+// writeCacheAge tells the client how many seconds old a cached response is.
+func writeCacheAge(w http.ResponseWriter, t *cachedTable) {
+	w.Header().Set("X-Cache-Age", strconv.Itoa(int(time.Since(t.taken).Seconds())))
+}
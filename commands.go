@@ -0,0 +1,524 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var errInvalidCommand = errors.New("external command contains a newline")
+
+// command formats an external command and its arguments as Naemon expects
+// them, e.g. "ENABLE_SVC_CHECK;web01;HTTP".
+func command(name string, args ...string) string {
+	return strings.Join(append([]string{name}, args...), ";")
+}
+
+// sendCommands writes each external command to the Livestatus socket over a
+// single connection. Livestatus does not answer commands, so a nil error only
+// means they were delivered.
+func sendCommands(cmds ...string) error {
+	_, err := sendCommandBatches(cmds, len(cmds))
+	return err
+}
+
+// sendCommandBatches writes cmds over a single connection, size commands per
+// write with the socket deadline renewed for each batch. It returns how many
+// commands were written before any error.
+func sendCommandBatches(cmds []string, size int) (int, error) {
+	for _, c := range cmds {
+		if strings.ContainsAny(c, "\r\n") {
+			return 0, errInvalidCommand
+		}
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	f, err := net.DialTimeout("unix", *socket, *timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	sent := 0
+	defer func() { stateCache.invalidate(cmds[:sent]) }()
+	for sent < len(cmds) {
+		end := sent + size
+		if end > len(cmds) {
+			end = len(cmds)
+		}
+
+		var b strings.Builder
+		for _, c := range cmds[sent:end] {
+			fmt.Fprintf(&b, "COMMAND [%d] %s\n\n", time.Now().Unix(), c)
+		}
+		if err := f.SetDeadline(time.Now().Add(*timeout)); err != nil {
+			return sent, err
+		}
+		if _, err := io.WriteString(f, b.String()); err != nil {
+			return sent, err
+		}
+		sent = end
+	}
+
+	return sent, nil
+}
+
+// objectPatch is the body accepted by PATCH on hosts and services. Fields
+// left out of the request are not changed.
+type objectPatch struct {
+	ChecksEnabled        *bool `json:"checks_enabled"`
+	NotificationsEnabled *bool `json:"notifications_enabled"`
+	EventHandlerEnabled  *bool `json:"event_handler_enabled"`
+	FlapDetectionEnabled *bool `json:"flap_detection_enabled"`
+	// NextNotification delays the next problem notification until the
+	// given Unix time.
+	NextNotification *int `json:"next_notification"`
+}
+
+// validate rejects patches the core would silently ignore.
+func (p objectPatch) validate() error {
+	if p.NextNotification != nil && int64(*p.NextNotification) <= time.Now().Unix() {
+		return errors.New("next_notification must be in the future")
+	}
+	return nil
+}
+
+// boolCondition returns the Livestatus filter expression column = want, or
+// "" if want is nil.
+func boolCondition(column string, want *bool) string {
+	if want == nil {
+		return ""
+	}
+	if *want {
+		return column + " = 1"
+	}
+	return column + " = 0"
+}
+
+// conditions returns the filter expressions that hold once p has been
+// applied.
+func (p objectPatch) conditions() []string {
+	conds := nonEmpty(
+		boolCondition("checks_enabled", p.ChecksEnabled),
+		boolCondition("notifications_enabled", p.NotificationsEnabled),
+		boolCondition("event_handler_enabled", p.EventHandlerEnabled),
+		boolCondition("flap_detection_enabled", p.FlapDetectionEnabled),
+	)
+	if p.NextNotification != nil {
+		conds = append(conds, "next_notification = "+strconv.Itoa(*p.NextNotification))
+	}
+	return conds
+}
+
+// delayCommand returns the command delaying the next notification when want
+// differs from the current value, and "" otherwise.
+func delayCommand(want *int, current int, name string, args ...string) string {
+	if want == nil || *want == current {
+		return ""
+	}
+	return command(name, append(args, strconv.Itoa(*want))...)
+}
+
+// toggleCommand returns the enable or disable command when want differs from
+// the current value, and "" otherwise.
+func toggleCommand(want *bool, current bool, enable, disable string, args ...string) string {
+	if want == nil || *want == current {
+		return ""
+	}
+	if *want {
+		return command(enable, args...)
+	}
+	return command(disable, args...)
+}
+
+// nonEmpty drops the empty strings returned for unchanged fields.
+func nonEmpty(cmds ...string) []string {
+	var out []string
+	for _, c := range cmds {
+		if c != "" {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// hostPatchCommands returns the external commands needed to bring h in line
+// with p.
+func hostPatchCommands(h *Host, p objectPatch) []string {
+	return nonEmpty(
+		toggleCommand(p.ChecksEnabled, h.ChecksEnabled, "ENABLE_HOST_CHECK", "DISABLE_HOST_CHECK", h.Name),
+		toggleCommand(p.NotificationsEnabled, h.NotificationsEnabled, "ENABLE_HOST_NOTIFICATIONS", "DISABLE_HOST_NOTIFICATIONS", h.Name),
+		toggleCommand(p.EventHandlerEnabled, h.EventHandlerEnabled, "ENABLE_HOST_EVENT_HANDLER", "DISABLE_HOST_EVENT_HANDLER", h.Name),
+		toggleCommand(p.FlapDetectionEnabled, h.FlapDetectionEnabled, "ENABLE_HOST_FLAP_DETECTION", "DISABLE_HOST_FLAP_DETECTION", h.Name),
+		delayCommand(p.NextNotification, h.NextNotification, "DELAY_HOST_NOTIFICATION", h.Name),
+	)
+}
+
+// servicePatchCommands returns the external commands needed to bring s in
+// line with p.
+func servicePatchCommands(s *Service, p objectPatch) []string {
+	return nonEmpty(
+		toggleCommand(p.ChecksEnabled, s.ChecksEnabled, "ENABLE_SVC_CHECK", "DISABLE_SVC_CHECK", s.HostName, s.Description),
+		toggleCommand(p.NotificationsEnabled, s.NotificationsEnabled, "ENABLE_SVC_NOTIFICATIONS", "DISABLE_SVC_NOTIFICATIONS", s.HostName, s.Description),
+		toggleCommand(p.EventHandlerEnabled, s.EventHandlerEnabled, "ENABLE_SVC_EVENT_HANDLER", "DISABLE_SVC_EVENT_HANDLER", s.HostName, s.Description),
+		toggleCommand(p.FlapDetectionEnabled, s.FlapDetectionEnabled, "ENABLE_SVC_FLAP_DETECTION", "DISABLE_SVC_FLAP_DETECTION", s.HostName, s.Description),
+		delayCommand(p.NextNotification, s.NextNotification, "DELAY_SVC_NOTIFICATION", s.HostName, s.Description),
+	)
+}
+
+// commandAuthor returns the author recorded on acknowledgements, comments,
+// downtimes and notifications: the one given in the request body, or else
+// the requesting user. Arguments follow the author, so it may not contain
+// semicolons, and a line break would end the command.
+func commandAuthor(r *http.Request, author string) (string, error) {
+	if author == "" {
+		author = requestUser(r)
+	}
+	if author == "" {
+		author = "livestatus-api"
+	}
+	if strings.ContainsAny(author, ";\r\n") {
+		return "", errors.New("author must not contain semicolons or line breaks")
+	}
+	return author, nil
+}
+
+// checkComment returns an error if comment, the last argument of a command,
+// contains a line break, which would end the command.
+func checkComment(comment string) error {
+	if strings.ContainsAny(comment, "\r\n") {
+		return errors.New("comment must not contain line breaks")
+	}
+	return nil
+}
+
+// decodeBody reads a JSON object from the request body into v, rejecting
+// fields v does not know about so read-only fields are not silently ignored.
+func decodeBody(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+func patchHost(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var patch objectPatch
+
+	if err := decodeBody(r, &patch); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := patch.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	wait, err := parseWait(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	host, err := findHost(vars["name"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if host == nil {
+		writeError(w, http.StatusNotFound, "Host not found")
+		return
+	}
+
+	if cmds := hostPatchCommands(host, patch); len(cmds) > 0 {
+		if err := sendCommands(cmds...); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		audit(r, "hosts/"+host.Name, cmds)
+		if wait > 0 {
+			ok, err := hostConfirmation(host.Name, patch.conditions()...).wait(time.Now().Add(wait))
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if !ok {
+				writeAccepted(w, hostURL(host.Name))
+				return
+			}
+		}
+		if host, err = findHost(vars["name"]); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	writeJSON(w, r, host)
+}
+
+func patchService(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var patch objectPatch
+
+	if err := decodeBody(r, &patch); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := patch.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	wait, err := parseWait(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	service, err := findService(vars["host_name"], vars["name"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if service == nil {
+		writeError(w, http.StatusNotFound, "Service not found")
+		return
+	}
+
+	if cmds := servicePatchCommands(service, patch); len(cmds) > 0 {
+		if err := sendCommands(cmds...); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		audit(r, "hosts/"+service.HostName+"/services/"+service.Description, cmds)
+		if wait > 0 {
+			ok, err := serviceConfirmation(service.HostName, service.Description, patch.conditions()...).wait(time.Now().Add(wait))
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if !ok {
+				writeAccepted(w, serviceURL(service.HostName, service.Description))
+				return
+			}
+		}
+		if service, err = findService(vars["host_name"], vars["name"]); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	writeJSON(w, r, service)
+}
+
+// statusPatch is the body accepted by PATCH /status. Fields left out of the
+// request are not changed.
+type statusPatch struct {
+	EnableNotifications        *bool `json:"enable_notifications"`
+	ExecuteServiceChecks       *bool `json:"execute_service_checks"`
+	ExecuteHostChecks          *bool `json:"execute_host_checks"`
+	AcceptPassiveServiceChecks *bool `json:"accept_passive_service_checks"`
+	AcceptPassiveHostChecks    *bool `json:"accept_passive_host_checks"`
+	EnableEventHandlers        *bool `json:"enable_event_handlers"`
+	EnableFlapDetection        *bool `json:"enable_flap_detection"`
+	ProcessPerformanceData     *bool `json:"process_performance_data"`
+	CheckServiceFreshness      *bool `json:"check_service_freshness"`
+	CheckHostFreshness         *bool `json:"check_host_freshness"`
+	ObsessOverServices         *bool `json:"obsess_over_services"`
+	ObsessOverHosts            *bool `json:"obsess_over_hosts"`
+}
+
+// conditions returns the filter expressions that hold once p has been
+// applied.
+func (p statusPatch) conditions() []string {
+	return nonEmpty(
+		boolCondition("enable_notifications", p.EnableNotifications),
+		boolCondition("execute_service_checks", p.ExecuteServiceChecks),
+		boolCondition("execute_host_checks", p.ExecuteHostChecks),
+		boolCondition("accept_passive_service_checks", p.AcceptPassiveServiceChecks),
+		boolCondition("accept_passive_host_checks", p.AcceptPassiveHostChecks),
+		boolCondition("enable_event_handlers", p.EnableEventHandlers),
+		boolCondition("enable_flap_detection", p.EnableFlapDetection),
+		boolCondition("process_performance_data", p.ProcessPerformanceData),
+		boolCondition("check_service_freshness", p.CheckServiceFreshness),
+		boolCondition("check_host_freshness", p.CheckHostFreshness),
+		boolCondition("obsess_over_services", p.ObsessOverServices),
+		boolCondition("obsess_over_hosts", p.ObsessOverHosts),
+	)
+}
+
+// statusCommands returns the global external commands needed to bring s in
+// line with p.
+func statusCommands(s *Status, p statusPatch) []string {
+	return nonEmpty(
+		toggleCommand(p.EnableNotifications, s.EnableNotifications, "ENABLE_NOTIFICATIONS", "DISABLE_NOTIFICATIONS"),
+		toggleCommand(p.ExecuteServiceChecks, s.ExecuteServiceChecks, "START_EXECUTING_SVC_CHECKS", "STOP_EXECUTING_SVC_CHECKS"),
+		toggleCommand(p.ExecuteHostChecks, s.ExecuteHostChecks, "START_EXECUTING_HOST_CHECKS", "STOP_EXECUTING_HOST_CHECKS"),
+		toggleCommand(p.AcceptPassiveServiceChecks, s.AcceptPassiveServiceChecks, "START_ACCEPTING_PASSIVE_SVC_CHECKS", "STOP_ACCEPTING_PASSIVE_SVC_CHECKS"),
+		toggleCommand(p.AcceptPassiveHostChecks, s.AcceptPassiveHostChecks, "START_ACCEPTING_PASSIVE_HOST_CHECKS", "STOP_ACCEPTING_PASSIVE_HOST_CHECKS"),
+		toggleCommand(p.EnableEventHandlers, s.EnableEventHandlers, "ENABLE_EVENT_HANDLERS", "DISABLE_EVENT_HANDLERS"),
+		toggleCommand(p.EnableFlapDetection, s.EnableFlapDetection, "ENABLE_FLAP_DETECTION", "DISABLE_FLAP_DETECTION"),
+		toggleCommand(p.ProcessPerformanceData, s.ProcessPerformanceData, "ENABLE_PERFORMANCE_DATA", "DISABLE_PERFORMANCE_DATA"),
+		toggleCommand(p.CheckServiceFreshness, s.CheckServiceFreshness, "ENABLE_SERVICE_FRESHNESS_CHECKS", "DISABLE_SERVICE_FRESHNESS_CHECKS"),
+		toggleCommand(p.CheckHostFreshness, s.CheckHostFreshness, "ENABLE_HOST_FRESHNESS_CHECKS", "DISABLE_HOST_FRESHNESS_CHECKS"),
+		toggleCommand(p.ObsessOverServices, s.ObsessOverServices, "START_OBSESSING_OVER_SVC_CHECKS", "STOP_OBSESSING_OVER_SVC_CHECKS"),
+		toggleCommand(p.ObsessOverHosts, s.ObsessOverHosts, "START_OBSESSING_OVER_HOST_CHECKS", "STOP_OBSESSING_OVER_HOST_CHECKS"),
+	)
+}
+
+func patchStatus(w http.ResponseWriter, r *http.Request) {
+	var patch statusPatch
+
+	if err := decodeBody(r, &patch); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	wait, err := parseWait(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	status, err := findStatus()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if cmds := statusCommands(status, patch); len(cmds) > 0 {
+		if err := sendCommands(cmds...); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		audit(r, "status", cmds)
+		if wait > 0 {
+			c := confirmation{table: "status", filters: patch.conditions()}
+			ok, err := c.wait(time.Now().Add(wait))
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if !ok {
+				writeAccepted(w, "/status")
+				return
+			}
+		}
+		if status, err = findStatus(); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	writeJSON(w, r, status)
+}
+
+// notificationRequest is the body accepted by POST on a host or service
+// notification resource.
+type notificationRequest struct {
+	Author    string `json:"author"`
+	Comment   string `json:"comment"`
+	Broadcast bool   `json:"broadcast"`
+	Forced    bool   `json:"forced"`
+	Increment bool   `json:"increment"`
+}
+
+// options returns the SEND_CUSTOM_*_NOTIFICATION options bitmask.
+func (n notificationRequest) options() string {
+	o := 0
+	if n.Broadcast {
+		o |= 1
+	}
+	if n.Forced {
+		o |= 2
+	}
+	if n.Increment {
+		o |= 4
+	}
+	return strconv.Itoa(o)
+}
+
+// decodeNotification reads and validates a notificationRequest, writing an
+// error response and returning false if it is unusable.
+func decodeNotification(w http.ResponseWriter, r *http.Request, n *notificationRequest) bool {
+	if err := decodeBody(r, n); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	if n.Comment == "" {
+		writeError(w, http.StatusBadRequest, "a comment is required")
+		return false
+	}
+	if err := checkComment(n.Comment); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	var err error
+	if n.Author, err = commandAuthor(r, n.Author); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+func postHostNotification(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var n notificationRequest
+
+	if !decodeNotification(w, r, &n) {
+		return
+	}
+
+	host, err := findHost(vars["name"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if host == nil {
+		writeError(w, http.StatusNotFound, "Host not found")
+		return
+	}
+
+	cmd := command("SEND_CUSTOM_HOST_NOTIFICATION", host.Name, n.options(), n.Author, n.Comment)
+	if err := sendCommands(cmd); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	audit(r, "hosts/"+host.Name, []string{cmd})
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func postServiceNotification(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var n notificationRequest
+
+	if !decodeNotification(w, r, &n) {
+		return
+	}
+
+	service, err := findService(vars["host_name"], vars["name"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if service == nil {
+		writeError(w, http.StatusNotFound, "Service not found")
+		return
+	}
+
+	cmd := command("SEND_CUSTOM_SVC_NOTIFICATION", service.HostName, service.Description, n.options(), n.Author, n.Comment)
+	if err := sendCommands(cmd); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	audit(r, "hosts/"+service.HostName+"/services/"+service.Description, []string{cmd})
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}}
+	zstdWriters = sync.Pool{New: func() interface{} {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return w
+	}}
+)
+
+// compress encodes responses with zstd or gzip when the client accepts them.
+// Websocket upgrades are passed through untouched.
+func compress(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Header.Get("Upgrade") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// Byte ranges would refer to the uncompressed body.
+		r.Header.Del("Range")
+		// Strong ETags must differ between encodings, so the encoding is
+		// appended to them and stripped again from validators.
+		if inm := r.Header.Get("If-None-Match"); inm != "" {
+			r.Header.Set("If-None-Match", strings.ReplaceAll(inm, "-"+encoding+`"`, `"`))
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, code: http.StatusOK}
+		defer cw.Close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks the supported content coding the client prefers
+// from an Accept-Encoding header, favoring zstd on ties, or "" for none.
+func negotiateEncoding(accept string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "zstd" && name != "gzip" {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				q = 0
+			}
+		}
+		if q > bestQ || (q == bestQ && q > 0 && name == "zstd") {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressWriter compresses what a handler writes. The status line is held
+// back until the first write so that responses without a body, such as 304
+// Not Modified, are sent uncompressed.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	code        int
+	wroteHeader bool
+	w           io.WriteCloser
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if !c.wroteHeader {
+		c.code = code
+	}
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		h := c.Header()
+		// net/http only sniffs the type of uncompressed bodies.
+		if h.Get("Content-Type") == "" {
+			h.Set("Content-Type", http.DetectContentType(b))
+		}
+		c.writeHeader(true)
+	}
+	if c.w == nil {
+		return c.ResponseWriter.Write(b)
+	}
+	return c.w.Write(b)
+}
+
+// writeHeader sends the status line, setting up compression if the response
+// will have a body.
+func (c *compressWriter) writeHeader(body bool) {
+	c.wroteHeader = true
+	h := c.Header()
+	if body || c.code == http.StatusNotModified {
+		if etag := h.Get("ETag"); strings.HasSuffix(etag, `"`) && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+c.encoding+`"`)
+		}
+	}
+	if body && h.Get("Content-Encoding") == "" {
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+		switch c.encoding {
+		case "gzip":
+			gz := gzipWriters.Get().(*gzip.Writer)
+			gz.Reset(c.ResponseWriter)
+			c.w = gz
+		case "zstd":
+			zw := zstdWriters.Get().(*zstd.Encoder)
+			zw.Reset(c.ResponseWriter)
+			c.w = zw
+		}
+	}
+	c.ResponseWriter.WriteHeader(c.code)
+}
+
+// Flush sends what has been compressed so far, for streamed responses.
+func (c *compressWriter) Flush() {
+	if !c.wroteHeader {
+		c.writeHeader(true)
+	}
+	switch w := c.w.(type) {
+	case *gzip.Writer:
+		w.Flush()
+	case *zstd.Encoder:
+		w.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the compressed stream and returns its encoder to the pool.
+func (c *compressWriter) Close() error {
+	if !c.wroteHeader {
+		c.writeHeader(false)
+	}
+	if c.w == nil {
+		return nil
+	}
+	err := c.w.Close()
+	switch w := c.w.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(w)
+	case *zstd.Encoder:
+		w.Reset(nil)
+		zstdWriters.Put(w)
+	}
+	c.w = nil
+	return err
+}
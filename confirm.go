@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxWait caps the wait parameter accepted by endpoints that send commands.
+const maxWait = time.Minute
+
+// confirmPollInterval is how often tables Livestatus cannot wait on are
+// re-read while confirming a command.
+const confirmPollInterval = 250 * time.Millisecond
+
+// confirmColumns is the column fetched from each table when all that matters
+// is whether a row matched.
+var confirmColumns = map[string]string{
+	"comments":  "id",
+	"downtimes": "id",
+	"hosts":     "name",
+	"services":  "description",
+	"status":    "program_start",
+}
+
+// confirmation describes a Livestatus query that returns a row once an
+// external command has taken effect.
+type confirmation struct {
+	table string
+	// object is the WaitObject for the hosts and services tables.
+	object string
+	// filters are Livestatus filter expressions that must all match.
+	filters []string
+}
+
+// hostConfirmation waits for conds to hold on the named host.
+func hostConfirmation(name string, conds ...string) confirmation {
+	return confirmation{
+		table:   "hosts",
+		object:  name,
+		filters: append([]string{"name = " + name}, conds...),
+	}
+}
+
+// serviceConfirmation waits for conds to hold on the service name of
+// hostName.
+func serviceConfirmation(hostName, name string, conds ...string) confirmation {
+	return confirmation{
+		table:   "services",
+		object:  hostName + ";" + name,
+		filters: append([]string{"host_name = " + hostName, "description = " + name}, conds...),
+	}
+}
+
+// waitable reports whether Livestatus can block on c with its Wait headers
+// instead of c being polled.
+func (c confirmation) waitable() bool {
+	return c.object != "" || c.table == "status"
+}
+
+// check runs c once, blocking in Livestatus until deadline if c is waitable,
+// and reports whether it matched.
+func (c confirmation) check(deadline time.Time) (bool, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "GET %s\n", c.table)
+	for _, f := range c.filters {
+		fmt.Fprintf(&b, "Filter: %s\n", f)
+	}
+	if c.waitable() {
+		b.WriteString(waitHeaders(c.object, c.filters, "all", time.Until(deadline)))
+	}
+	b.WriteString("Columns: " + confirmColumns[c.table])
+
+	raw, err := queryDeadline(b.String(), deadline.Add(*timeout))
+	if err != nil {
+		return false, err
+	}
+	defer raw.Close()
+
+	var rows [][]interface{}
+	if err := json.NewDecoder(raw).Decode(&rows); err != nil {
+		return false, err
+	}
+	return len(rows) > 0, nil
+}
+
+// wait blocks until c matches or deadline passes, and reports whether it
+// matched.
+func (c confirmation) wait(deadline time.Time) (bool, error) {
+	for {
+		ok, err := c.check(deadline)
+		if err != nil || ok || c.waitable() || !time.Now().Before(deadline) {
+			return ok, err
+		}
+		time.Sleep(confirmPollInterval)
+	}
+}
+
+// waitTriggers are the events Livestatus' WaitTrigger header accepts.
+var waitTriggers = map[string]bool{
+	"all": true, "check": true, "state": true, "log": true,
+	"downtime": true, "comment": true, "command": true, "program": true,
+}
+
+// waitHeaders returns the Livestatus headers that block a query until all
+// conds hold for object, re-checking them each time trigger fires, for at
+// most timeout.
+func waitHeaders(object string, conds []string, trigger string, timeout time.Duration) string {
+	var b strings.Builder
+	if object != "" {
+		fmt.Fprintf(&b, "WaitObject: %s\n", object)
+	}
+	for _, c := range conds {
+		fmt.Fprintf(&b, "WaitCondition: %s\n", c)
+	}
+	// A WaitTimeout of 0 waits forever.
+	ms := timeout.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	fmt.Fprintf(&b, "WaitTrigger: %s\nWaitTimeout: %d\n", trigger, ms)
+	return b.String()
+}
+
+// parseLongPoll returns the Wait headers for the wait_trigger,
+// wait_condition and wait_timeout parameters of a request for object in
+// table, and the deadline for the query. Requests without them get no
+// headers and the usual deadline.
+func parseLongPoll(r *http.Request, table, object string) (string, time.Time, error) {
+	q := r.URL.Query()
+	trigger, conds, waitTimeout := q.Get("wait_trigger"), q["wait_condition"], q.Get("wait_timeout")
+	if trigger == "" && len(conds) == 0 && waitTimeout == "" {
+		return "", time.Now().Add(*timeout), nil
+	}
+
+	if trigger == "" {
+		trigger = "all"
+	}
+	if !waitTriggers[trigger] {
+		return "", time.Time{}, fmt.Errorf("invalid wait_trigger %q", trigger)
+	}
+	fs, err := parseFilterExprs(table, tableColumns[table], conds)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	d := maxWait
+	if waitTimeout != "" {
+		if d, err = time.ParseDuration(waitTimeout); err != nil || d <= 0 {
+			return "", time.Time{}, fmt.Errorf("invalid wait_timeout %q", waitTimeout)
+		}
+		if d > maxWait {
+			d = maxWait
+		}
+	}
+
+	exprs := make([]string, len(fs))
+	for i, f := range fs {
+		exprs[i] = f.String()
+	}
+	return waitHeaders(object, exprs, trigger, d), time.Now().Add(d + *timeout), nil
+}
+
+// parseWait returns how long a request asked to wait for its commands to be
+// confirmed, from the wait query parameter. Zero means not to wait.
+func parseWait(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("wait")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid wait %q", v)
+	}
+	if d > maxWait {
+		d = maxWait
+	}
+	return d, nil
+}
+
+// writeAccepted tells the client its commands were sent but not yet seen to
+// take effect, and where to poll for the result.
+func writeAccepted(w http.ResponseWriter, location string) {
+	w.Header().Set("Location", location)
+	writeError(w, http.StatusAccepted, "Command sent but not yet confirmed, see "+location)
+}
+
+func hostURL(name string) string {
+	return "/hosts/" + url.PathEscape(name)
+}
+
+func serviceURL(hostName, name string) string {
+	return hostURL(hostName) + "/services/" + url.PathEscape(name)
+}
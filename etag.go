@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// writeJSON encodes v as the response to a read request with a strong ETag
+// of its content and, for hosts and services, a Last-Modified time.
+// Conditional requests whose validators match get 304 Not Modified. v is
+// rendered in the human or HAL representation if r asks for it.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	loc, err := parseRepr(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	hal := parseHAL(w, r)
+	if hal != nil {
+		if err := hal.check(v); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := hal.load(v); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/hal+json")
+	}
+	out := v
+	if loc != nil || hal != nil {
+		out = represent(v, loc, hal)
+	}
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(out); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256(b.Bytes())))
+	http.ServeContent(w, r, "", lastModified(v), bytes.NewReader(b.Bytes()))
+}
+
+// lastModified returns the newest last_check or last_state_change of the
+// hosts and services in v, or the zero time if v has none.
+func lastModified(v interface{}) time.Time {
+	newest := 0
+	switch v := v.(type) {
+	case []Host:
+		for i := range v {
+			newest = max(newest, objectModified(&v[i]))
+		}
+	case []Service:
+		for i := range v {
+			newest = max(newest, objectModified(&v[i]))
+		}
+	case []interface{}:
+		for _, o := range v {
+			newest = max(newest, objectModified(o))
+		}
+	default:
+		newest = objectModified(v)
+	}
+
+	if newest <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(newest), 0)
+}
+
+func objectModified(v interface{}) int {
+	switch o := v.(type) {
+	case Host:
+		return max(o.LastCheck, o.LastStateChange)
+	case *Host:
+		return max(o.LastCheck, o.LastStateChange)
+	case Service:
+		return max(o.LastCheck, o.LastStateChange)
+	case *Service:
+		return max(o.LastCheck, o.LastStateChange)
+	}
+	return 0
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventPollTimeout is how long each long-poll of the log table waits for new
+// entries before the stream sends a keepalive.
+const eventPollTimeout = 15 * time.Second
+
+// eventColumns are the Event fields /events can be filtered on.
+const eventColumns = "id type time host_name service_description state state_type phase author comment output"
+
+// Event is a change streamed from /events, derived from a Livestatus log
+// entry.
+type Event struct {
+	ID string `json:"id"`
+	// Type is state, acknowledgement, downtime or comment.
+	Type               string `json:"type"`
+	Time               int    `json:"time"`
+	HostName           string `json:"host_name"`
+	ServiceDescription string `json:"service_description,omitempty"`
+	State              int    `json:"state"`
+	StateType          string `json:"state_type,omitempty"`
+	// Phase is STARTED, STOPPED or CANCELLED for downtimes and added or
+	// removed for acknowledgements.
+	Phase   string `json:"phase,omitempty"`
+	Author  string `json:"author,omitempty"`
+	Comment string `json:"comment,omitempty"`
+	Output  string `json:"output,omitempty"`
+}
+
+// eventID identifies a log entry by its time and its position among the
+// streamed entries of that second. Line numbers are not used, as they start
+// over when the log is rotated. Livestatus returns log entries in the order
+// they were written, so IDs can be used to resume a stream.
+func eventID(time, seq int) string {
+	return fmt.Sprintf("%d-%d", time, seq)
+}
+
+// parseEventID is the inverse of eventID.
+func parseEventID(id string) (int, int, error) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid event id %q", id)
+	}
+	t, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid event id %q", id)
+	}
+	l, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid event id %q", id)
+	}
+	return t, l, nil
+}
+
+// logEvent turns a log entry into an Event, or returns nil for entries that
+// are not streamed.
+func logEvent(l *LogEntry) *Event {
+	e := &Event{
+		Time:               l.Time,
+		HostName:           l.HostName,
+		ServiceDescription: l.ServiceDescription,
+		State:              l.State,
+	}
+	opts := strings.Split(l.Options, ";")
+
+	switch l.Type {
+	case "HOST ALERT", "SERVICE ALERT":
+		e.Type = "state"
+		e.StateType = l.StateType
+		e.Output = l.PluginOutput
+	case "HOST DOWNTIME ALERT":
+		if len(opts) < 2 {
+			return nil
+		}
+		e.Type = "downtime"
+		e.HostName = opts[0]
+		e.Phase = opts[1]
+	case "SERVICE DOWNTIME ALERT":
+		if len(opts) < 3 {
+			return nil
+		}
+		e.Type = "downtime"
+		e.HostName, e.ServiceDescription = opts[0], opts[1]
+		e.Phase = opts[2]
+	case "EXTERNAL COMMAND":
+		return commandEvent(e, opts)
+	default:
+		return nil
+	}
+	return e
+}
+
+// commandEvent fills in e from the options of an EXTERNAL COMMAND log entry,
+// which Livestatus does not split into host and service columns.
+func commandEvent(e *Event, opts []string) *Event {
+	// rest joins the trailing arguments back together, since comments may
+	// contain semicolons.
+	rest := func(i int) string {
+		if len(opts) <= i {
+			return ""
+		}
+		return strings.Join(opts[i:], ";")
+	}
+	arg := func(i int) string {
+		if len(opts) <= i {
+			return ""
+		}
+		return opts[i]
+	}
+
+	switch opts[0] {
+	case "ACKNOWLEDGE_HOST_PROBLEM":
+		e.Type, e.Phase = "acknowledgement", "added"
+		e.HostName, e.Author, e.Comment = arg(1), arg(5), rest(6)
+	case "ACKNOWLEDGE_SVC_PROBLEM":
+		e.Type, e.Phase = "acknowledgement", "added"
+		e.HostName, e.ServiceDescription, e.Author, e.Comment = arg(1), arg(2), arg(6), rest(7)
+	case "REMOVE_HOST_ACKNOWLEDGEMENT":
+		e.Type, e.Phase = "acknowledgement", "removed"
+		e.HostName = arg(1)
+	case "REMOVE_SVC_ACKNOWLEDGEMENT":
+		e.Type, e.Phase = "acknowledgement", "removed"
+		e.HostName, e.ServiceDescription = arg(1), arg(2)
+	case "ADD_HOST_COMMENT":
+		e.Type = "comment"
+		e.HostName, e.Author, e.Comment = arg(1), arg(3), rest(4)
+	case "ADD_SVC_COMMENT":
+		e.Type = "comment"
+		e.HostName, e.ServiceDescription, e.Author, e.Comment = arg(1), arg(2), arg(4), rest(5)
+	default:
+		return nil
+	}
+	return e
+}
+
+// eventCursor is the position of the last log entry a stream has passed,
+// see eventID.
+type eventCursor struct {
+	time, seq int
+}
+
+// next returns the events for the entries after c, advancing c past them.
+// entries must be every streamed entry since c's second, as tailLog returns
+// them, so their positions within each second can be counted.
+func (c *eventCursor) next(entries []LogEntry) []*Event {
+	var events []*Event
+	second, seq := -1, 0
+	for i := range entries {
+		l := &entries[i]
+		if l.Time != second {
+			second, seq = l.Time, 0
+		}
+		seq++
+		if l.Time < c.time || (l.Time == c.time && seq <= c.seq) {
+			continue
+		}
+		c.time, c.seq = l.Time, seq
+
+		if e := logEvent(l); e != nil {
+			e.ID = eventID(l.Time, seq)
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// tailLog long-polls the log table for alert and external command entries
+// written at or after since, blocking until Livestatus logs something or
+// eventPollTimeout passes.
+func tailLog(since int) ([]LogEntry, error) {
+	var entries []LogEntry
+
+	q := fmt.Sprintf("GET log\nFilter: time >= %d\nFilter: class = 1\nFilter: class = 5\nOr: 2\nWaitTrigger: log\nWaitTimeout: %d\nColumns:%s",
+		since, eventPollTimeout.Milliseconds(), logColumns)
+	raw, err := queryDeadline(q, time.Now().Add(eventPollTimeout+*timeout))
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+
+	if err := json.NewDecoder(raw).Decode(&entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func getEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+
+	filters, err := parseFilterExprs("event", eventColumns, r.URL.Query()["filter"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Without a Last-Event-ID the stream starts with what happens next.
+	// EventSource cannot set headers on its first request, so the ID may also
+	// be passed as a query parameter.
+	cursor := eventCursor{time: int(time.Now().Unix())}
+	id := r.Header.Get("Last-Event-ID")
+	if id == "" {
+		id = r.URL.Query().Get("last_event_id")
+	}
+	if id != "" {
+		if cursor.time, cursor.seq, err = parseEventID(id); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		default:
+		}
+
+		entries, err := tailLog(cursor.time)
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+			flusher.Flush()
+			return
+		}
+
+		for _, e := range cursor.next(entries) {
+			if !matchAll(filters, fieldsOf(e)) {
+				continue
+			}
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		}
+		// A comment line keeps proxies from timing out idle streams.
+		fmt.Fprint(w, ": keepalive\n\n")
+		flusher.Flush()
+	}
+}
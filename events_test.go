@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEventCursorAcrossRotation(t *testing.T) {
+	// The log is rotated within second 100: line numbers start over.
+	entries := []LogEntry{
+		{Time: 99, LineNumber: 7, Type: "HOST ALERT", HostName: "a"},
+		{Time: 100, LineNumber: 8, Type: "HOST ALERT", HostName: "b"},
+		{Time: 100, LineNumber: 9, Type: "LOG ROTATION"},
+		{Time: 100, LineNumber: 1, Type: "HOST ALERT", HostName: "c"},
+		{Time: 101, LineNumber: 2, Type: "HOST ALERT", HostName: "d"},
+	}
+	ids := func(events []*Event) []string {
+		var out []string
+		for _, e := range events {
+			out = append(out, e.ID+" "+e.HostName)
+		}
+		return out
+	}
+
+	c := eventCursor{time: 99}
+	all := c.next(entries)
+	if want := []string{"99-1 a", "100-1 b", "100-3 c", "101-1 d"}; !reflect.DeepEqual(ids(all), want) {
+		t.Fatalf("events = %q, want %q", ids(all), want)
+	}
+	if c != (eventCursor{101, 1}) {
+		t.Errorf("cursor = %+v", c)
+	}
+
+	// A client that saw b resumes with c, though c's line number is lower,
+	// from what tailLog returns for second 100 on.
+	time, seq, err := parseEventID("100-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = eventCursor{time, seq}
+	if got, want := ids(c.next(entries[1:])), []string{"100-3 c", "101-1 d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resumed events = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// tableColumns maps each table the API serves to the columns it may be
+// filtered on.
+var tableColumns = map[string]string{
+	"comments":  commentColumns,
+	"contacts":  contactColumns,
+	"downtimes": downtimeColumns,
+	"hosts":     hostColumns,
+	"log":       logColumns,
+	"services":  serviceColumns,
+}
+
+// tableTypes maps each table to the type its rows are decoded into. Fields
+// are declared in the same order as the table's columns.
+var tableTypes = map[string]reflect.Type{
+	"comments":  reflect.TypeOf(Comment{}),
+	"contacts":  reflect.TypeOf(Contact{}),
+	"downtimes": reflect.TypeOf(Downtime{}),
+	"hosts":     reflect.TypeOf(Host{}),
+	"log":       reflect.TypeOf(LogEntry{}),
+	"services":  reflect.TypeOf(Service{}),
+}
+
+// filterOperators are the Livestatus filter operators accepted in filter
+// expressions.
+var filterOperators = map[string]bool{
+	"=": true, "!=": true,
+	"~": true, "!~": true,
+	"=~": true, "!=~": true,
+	"~~": true, "!~~": true,
+	"<": true, ">": true,
+	"<=": true, ">=": true,
+}
+
+// filterExpr is a parsed filter expression of the form "column operator
+// value".
+type filterExpr struct {
+	column string
+	op     string
+	value  string
+	// re is the compiled value for the regular expression operators.
+	re *regexp.Regexp
+}
+
+func (f filterExpr) String() string {
+	return f.column + " " + f.op + " " + f.value
+}
+
+// parseFilterExprs parses filter expressions such as "state = 2" or
+// "groups >= web". Columns must be one of the space separated names in
+// columns, which describe what is being filtered.
+func parseFilterExprs(what, columns string, exprs []string) ([]filterExpr, error) {
+	var out []filterExpr
+	for _, expr := range exprs {
+		if strings.ContainsAny(expr, "\r\n") {
+			return nil, fmt.Errorf("filter %q contains a newline", expr)
+		}
+
+		parts := strings.SplitN(strings.TrimSpace(expr), " ", 3)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("filter %q is not of the form \"column operator value\"", expr)
+		}
+		if !hasField(columns, parts[0]) {
+			return nil, fmt.Errorf("filter %q: unknown %s column %q", expr, what, parts[0])
+		}
+		if !filterOperators[parts[1]] {
+			return nil, fmt.Errorf("filter %q: unknown operator %q", expr, parts[1])
+		}
+
+		f := filterExpr{column: parts[0], op: parts[1]}
+		if len(parts) == 3 {
+			f.value = parts[2]
+		}
+		switch strings.TrimPrefix(f.op, "!") {
+		case "~":
+			re, err := regexp.Compile(f.value)
+			if err != nil {
+				return nil, fmt.Errorf("filter %q: %v", expr, err)
+			}
+			f.re = re
+		case "~~":
+			re, err := regexp.Compile("(?i)" + f.value)
+			if err != nil {
+				return nil, fmt.Errorf("filter %q: %v", expr, err)
+			}
+			f.re = re
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// parseFilters turns filter expressions into Livestatus Filter headers for
+// table. Multiple expressions must all match.
+func parseFilters(table string, exprs []string) (string, error) {
+	fs, err := parseFilterExprs(table, tableColumns[table], exprs)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, f := range fs {
+		fmt.Fprintf(&b, "Filter: %s\n", f)
+	}
+	return b.String(), nil
+}
+
+// customPrefix marks query parameters that filter hosts and services on a
+// custom variable, as in custom.ENV=prod.
+const customPrefix = "custom."
+
+// parseCustomFilters returns the custom variables q filters on, by their
+// upper case name as the core stores them.
+func parseCustomFilters(q url.Values) (map[string]string, error) {
+	vars := make(map[string]string)
+	for k, vs := range q {
+		if !strings.HasPrefix(k, customPrefix) {
+			continue
+		}
+		name := strings.ToUpper(strings.TrimPrefix(k, customPrefix))
+		if name == "" || strings.ContainsAny(name, " \t\r\n") {
+			return nil, fmt.Errorf("invalid custom variable %q", k)
+		}
+		if len(vs) > 1 {
+			return nil, fmt.Errorf("custom variable %q given more than once", k)
+		}
+		if strings.ContainsAny(vs[0], "\r\n") {
+			return nil, fmt.Errorf("custom variable %q contains a newline", k)
+		}
+		vars[name] = vs[0]
+	}
+	return vars, nil
+}
+
+// customFilters turns custom variable filters into Livestatus Filter headers.
+func customFilters(vars map[string]string) string {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "Filter: custom_variables = %s %s\n", name, vars[name])
+	}
+	return b.String()
+}
+
+// matchCustom reports whether the custom_variables of an already fetched
+// object, see fieldsOf, have all of vars.
+func matchCustom(vars map[string]string, fields map[string]interface{}) bool {
+	custom, _ := fields["custom_variables"].(map[string]interface{})
+	for name, v := range vars {
+		if custom[name] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// customVariables pairs up the custom_variable_names and
+// custom_variable_values columns.
+func customVariables(names, values []string) map[string]string {
+	vars := make(map[string]string, len(names))
+	for i, name := range names {
+		if i < len(values) {
+			vars[name] = values[i]
+		}
+	}
+	return vars
+}
+
+// columnField returns the JSON field table's column is served as, which is
+// not always the column name (e.g. a service's host_name is served as host).
+func columnField(table, column string) string {
+	t := tableTypes[table]
+	for i, c := range strings.Fields(tableColumns[table]) {
+		if c == column && i < t.NumField() {
+			return strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		}
+	}
+	return column
+}
+
+// parseFieldFilters parses filter expressions on table's Livestatus columns
+// for matching against the JSON fields of already fetched objects, see
+// fieldsOf and matchAll.
+func parseFieldFilters(table string, exprs []string) ([]filterExpr, error) {
+	fs, err := parseFilterExprs(table, tableColumns[table], exprs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range fs {
+		fs[i].column = columnField(table, fs[i].column)
+	}
+	return fs, nil
+}
+
+// hasField reports whether name is one of the space separated names in
+// fields.
+func hasField(fields, name string) bool {
+	for _, f := range strings.Fields(fields) {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldsOf returns the JSON fields of v, for matching filter expressions
+// against values that were not fetched with a Livestatus filter.
+func fieldsOf(v interface{}) map[string]interface{} {
+	var m map[string]interface{}
+	b, _ := json.Marshal(v)
+	json.Unmarshal(b, &m)
+	return m
+}
+
+// matchAll reports whether every expression matches fields.
+func matchAll(fs []filterExpr, fields map[string]interface{}) bool {
+	for _, f := range fs {
+		if !f.match(fields[f.column]) {
+			return false
+		}
+	}
+	return true
+}
+
+// match evaluates f against a decoded JSON value the way Livestatus would
+// evaluate it against the column.
+func (f filterExpr) match(v interface{}) bool {
+	op := strings.TrimPrefix(f.op, "!")
+	ok := f.test(op, v)
+	if op != f.op {
+		return !ok
+	}
+	return ok
+}
+
+func (f filterExpr) test(op string, v interface{}) bool {
+	switch v := v.(type) {
+	case []interface{}:
+		switch op {
+		case "=":
+			return f.value == "" && len(v) == 0
+		case ">=", "<":
+			contains := false
+			for _, e := range v {
+				if fmt.Sprint(e) == f.value {
+					contains = true
+				}
+			}
+			return contains == (op == ">=")
+		case "<=":
+			for _, e := range v {
+				if strings.EqualFold(fmt.Sprint(e), f.value) {
+					return true
+				}
+			}
+		case "~", "~~":
+			for _, e := range v {
+				if f.re.MatchString(fmt.Sprint(e)) {
+					return true
+				}
+			}
+		}
+		return false
+	case bool:
+		if v {
+			return f.test(op, float64(1))
+		}
+		return f.test(op, float64(0))
+	case float64:
+		n, err := strconv.ParseFloat(f.value, 64)
+		if err != nil {
+			return false
+		}
+		switch op {
+		case "=", "=~":
+			return v == n
+		case "<":
+			return v < n
+		case ">":
+			return v > n
+		case "<=":
+			return v <= n
+		case ">=":
+			return v >= n
+		}
+		return false
+	case string:
+		switch op {
+		case "=":
+			return v == f.value
+		case "=~":
+			return strings.EqualFold(v, f.value)
+		case "~", "~~":
+			return f.re.MatchString(v)
+		case "<":
+			return v < f.value
+		case ">":
+			return v > f.value
+		case "<=":
+			return v <= f.value
+		case ">=":
+			return v >= f.value
+		}
+	}
+	return false
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// formatTypes maps the output formats of collection endpoints to their
+// content types. JSON is left for net/http to sniff as it always has been.
+var formatTypes = map[string]string{
+	"json":   "",
+	"ndjson": "application/x-ndjson",
+	"csv":    "text/csv; charset=utf-8",
+}
+
+// parseFormat returns the output format a collection request asked for, from
+// the format parameter or else the Accept header, defaulting to json.
+func parseFormat(w http.ResponseWriter, r *http.Request) (string, error) {
+	w.Header().Add("Vary", "Accept")
+
+	if f := r.URL.Query().Get("format"); f != "" {
+		if _, ok := formatTypes[f]; !ok {
+			return "", fmt.Errorf("unknown format %q", f)
+		}
+		return f, nil
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "application/x-ndjson"):
+		return "ndjson", nil
+	case strings.Contains(accept, "text/csv"):
+		return "csv", nil
+	}
+	return "json", nil
+}
+
+// rowWriter writes the rows of a table one at a time in an output format.
+type rowWriter struct {
+	format string
+	w      *bufio.Writer
+	csv    *csv.Writer
+	t      reflect.Type
+	n      int
+	// sel picks the fields written, and cols are their indexes for CSV.
+	sel  *rowSelection
+	cols []int
+	// loc is the time zone of the human representation, nil for raw rows,
+	// and hal the HAL view, nil for plain rows. CSV is always raw and plain.
+	loc *time.Location
+	hal *halView
+}
+
+func newRowWriter(w io.Writer, table, format string, loc *time.Location, hal *halView, sel *rowSelection) *rowWriter {
+	rw := &rowWriter{format: format, w: bufio.NewWriter(w), t: tableTypes[table], loc: loc, hal: hal, sel: sel}
+	if format == "csv" {
+		rw.cols = csvColumns(rw.t, sel.fields)
+		rw.csv = csv.NewWriter(rw.w)
+		rw.csv.Write(csvHeader(rw.t, rw.cols))
+	}
+	return rw
+}
+
+// write adds row, a value or pointer of the table's type.
+func (rw *rowWriter) write(row interface{}) error {
+	defer func() { rw.n++ }()
+
+	if rw.format == "csv" {
+		return rw.csv.Write(csvRecord(reflect.Indirect(reflect.ValueOf(row)), rw.cols))
+	}
+
+	if rw.loc != nil || rw.hal != nil {
+		row = represent(row, rw.loc, rw.hal)
+	}
+	if len(rw.sel.fields) > 0 {
+		m, ok := row.(map[string]interface{})
+		if !ok {
+			m = fieldsOf(row)
+		}
+		row = rw.sel.project(m)
+	}
+	b, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	switch {
+	case rw.format == "ndjson":
+		rw.w.Write(b)
+		return rw.w.WriteByte('\n')
+	case rw.n == 0:
+		rw.w.WriteByte('[')
+	default:
+		rw.w.WriteByte(',')
+	}
+	_, err = rw.w.Write(b)
+	return err
+}
+
+// close finishes the output. Empty JSON collections are null, as they are
+// when a nil slice is encoded.
+func (rw *rowWriter) close() error {
+	switch {
+	case rw.format == "csv":
+		rw.csv.Flush()
+	case rw.format == "ndjson":
+	case rw.n == 0:
+		rw.w.WriteString("null\n")
+	default:
+		rw.w.WriteString("]\n")
+	}
+	return rw.w.Flush()
+}
+
+// writeRows writes already fetched rows of table in format, with an ETag as
+// writeJSON does, in the order and with the fields r asked for.
+func writeRows(w http.ResponseWriter, r *http.Request, table, format string, rows []interface{}) {
+	sel, err := parseSelection(r, table)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sel.sortRows(rows)
+	if format == "json" && len(sel.fields) == 0 {
+		writeJSON(w, r, rows)
+		return
+	}
+
+	loc, err := parseRepr(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	hal := parseHAL(w, r)
+	if hal != nil && format != "csv" {
+		if err := hal.check(rows); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := hal.load(rows); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	var b bytes.Buffer
+	rw := newRowWriter(&b, table, format, loc, hal, sel)
+	for _, row := range rows {
+		if err := rw.write(row); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	rw.close()
+
+	if ct := formatTypes[format]; ct != "" {
+		w.Header().Set("Content-Type", ct)
+	} else if hal != nil {
+		w.Header().Set("Content-Type", "application/hal+json")
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256(b.Bytes())))
+	http.ServeContent(w, r, "", lastModified(rows), bytes.NewReader(b.Bytes()))
+}
+
+// csvColumns returns the indexes of the fields of t that are CSV columns:
+// those named in only, in that order, or else every JSON field.
+func csvColumns(t reflect.Type, only []string) []int {
+	var cols []int
+	if len(only) > 0 {
+		for _, name := range only {
+			if i, ok := fieldIndex(t, name); ok {
+				cols = append(cols, i)
+			}
+		}
+		return cols
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if jsonName(t.Field(i)) != "" {
+			cols = append(cols, i)
+		}
+	}
+	return cols
+}
+
+// csvHeader returns the JSON field names of the columns cols of t.
+func csvHeader(t reflect.Type, cols []int) []string {
+	header := make([]string, len(cols))
+	for i, c := range cols {
+		header[i] = jsonName(t.Field(c))
+	}
+	return header
+}
+
+// csvRecord returns the columns cols of v.
+func csvRecord(v reflect.Value, cols []int) []string {
+	record := make([]string, len(cols))
+	for i, c := range cols {
+		record[i] = csvValue(v.Field(c))
+	}
+	return record
+}
+
+// jsonName returns the name f is encoded under in JSON, or "" if it is not.
+func jsonName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return f.Name
+	}
+	return name
+}
+
+// csvValue formats a field for CSV. Lists are joined with commas and maps
+// become sorted key=value pairs, which the CSV writer quotes as needed.
+func csvValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		parts := make([]string, v.Len())
+		for i := range parts {
+			parts[i] = csvValue(v.Index(i))
+		}
+		return strings.Join(parts, ",")
+	case reflect.Map:
+		var parts []string
+		for _, k := range v.MapKeys() {
+			parts = append(parts, fmt.Sprint(k.Interface())+"="+csvValue(v.MapIndex(k)))
+		}
+		sort.Strings(parts)
+		return strings.Join(parts, ",")
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return ""
+		}
+		return csvValue(v.Elem())
+	case reflect.Struct:
+		b, _ := json.Marshal(v.Interface())
+		return string(b)
+	}
+	return fmt.Sprint(v.Interface())
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+const (
+	// graphqlMaxBatch is the most operations one request may hold.
+	graphqlMaxBatch = 20
+	// graphqlMaxDepth is how deeply the fields of a query may nest.
+	graphqlMaxDepth = 10
+	// graphqlMaxBody is the most bytes a POST body may hold.
+	graphqlMaxBody = 1 << 20
+)
+
+// graphqlSchema is served at /graphql, built by main.
+var graphqlSchema graphql.Schema
+
+type objectLoaderKey struct{}
+
+func loaderFrom(ctx context.Context) *objectLoader {
+	return ctx.Value(objectLoaderKey{}).(*objectLoader)
+}
+
+// graphqlTypes builds GraphQL object types mirroring the resource structs.
+type graphqlTypes struct {
+	objects map[reflect.Type]*graphql.Object
+}
+
+// customVariableType is a pair of a custom_variables map.
+var customVariableType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "CustomVariable",
+	Fields: graphql.Fields{
+		"name":  &graphql.Field{Type: graphql.String},
+		"value": &graphql.Field{Type: graphql.String},
+	},
+})
+
+func (g *graphqlTypes) output(t reflect.Type) graphql.Output {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.output(t.Elem())
+	case reflect.Bool:
+		return graphql.Boolean
+	case reflect.Int, reflect.Int64:
+		return graphql.Int
+	case reflect.Float64:
+		return graphql.Float
+	case reflect.String:
+		return graphql.String
+	case reflect.Slice:
+		if elem := g.output(t.Elem()); elem != nil {
+			return graphql.NewList(elem)
+		}
+	case reflect.Struct:
+		return g.object(t)
+	}
+	return nil
+}
+
+// object returns the GraphQL type of struct type t, with its JSON fields.
+// Maps of strings become lists of CustomVariable pairs.
+func (g *graphqlTypes) object(t reflect.Type) *graphql.Object {
+	if o, ok := g.objects[t]; ok {
+		return o
+	}
+
+	fields := graphql.Fields{}
+	o := graphql.NewObject(graphql.ObjectConfig{Name: t.Name(), Fields: fields})
+	g.objects[t] = o
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := jsonName(f)
+		if name == "" {
+			continue
+		}
+		if f.Type.Kind() == reflect.Map && f.Type.Elem().Kind() == reflect.String {
+			fields[name] = &graphql.Field{Type: graphql.NewList(customVariableType), Resolve: resolvePairs(i)}
+		} else if typ := g.output(f.Type); typ != nil {
+			fields[name] = &graphql.Field{Type: typ}
+		}
+	}
+	return o
+}
+
+func resolvePairs(field int) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		m := reflect.Indirect(reflect.ValueOf(p.Source)).Field(field).Interface().(map[string]string)
+		pairs := []map[string]interface{}{}
+		for _, name := range sortedKeys(m) {
+			pairs = append(pairs, map[string]interface{}{"name": name, "value": m[name]})
+		}
+		return pairs, nil
+	}
+}
+
+// relationField resolves the keys rel holds into the objects they refer to,
+// replacing the field they are in.
+func relationField(typ graphql.Output, rel objectRelation) *graphql.Field {
+	if !rel.one {
+		typ = graphql.NewList(typ)
+	}
+	return &graphql.Field{
+		Type: typ,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			keys := rel.keys(p.Source)
+			if rel.one {
+				if len(keys) == 0 {
+					return nil, nil
+				}
+				return loaderFrom(p.Context).loadOne(rel.table, keys[0]), nil
+			}
+			return loaderFrom(p.Context).load(rel.table, keys), nil
+		},
+	}
+}
+
+// listField is a root field listing the objects of table that match its
+// filter argument.
+func listField(typ graphql.Output, table string) *graphql.Field {
+	return &graphql.Field{
+		Type: graphql.NewList(typ),
+		Args: graphql.FieldConfigArgument{
+			"filter": &graphql.ArgumentConfig{
+				Type:        graphql.NewList(graphql.NewNonNull(graphql.String)),
+				Description: "Filter expressions as for the filter parameter of /" + table + ", all of which must match.",
+			},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			var exprs []string
+			if list, ok := p.Args["filter"].([]interface{}); ok {
+				for _, e := range list {
+					exprs = append(exprs, e.(string))
+				}
+			}
+			filters, err := parseFilters(table, exprs)
+			if err != nil {
+				return nil, err
+			}
+			rows, keys, err := queryTable(table, filters)
+			if err != nil {
+				return nil, err
+			}
+			loaderFrom(p.Context).add(table, rows, keys)
+			if rows == nil {
+				rows = []interface{}{}
+			}
+			return rows, nil
+		},
+	}
+}
+
+// objectField is a root field getting one object of table by the string
+// arguments that make up its key.
+func objectField(typ graphql.Output, table string, args ...string) *graphql.Field {
+	config := graphql.FieldConfigArgument{}
+	for _, a := range args {
+		config[a] = &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)}
+	}
+	return &graphql.Field{
+		Type: typ,
+		Args: config,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			parts := make([]string, len(args))
+			for i, a := range args {
+				parts[i] = p.Args[a].(string)
+				if strings.ContainsAny(parts[i], "\n;") {
+					return nil, fmt.Errorf("invalid %s %q", a, parts[i])
+				}
+			}
+			if (table == "comments" || table == "downtimes") && strings.Trim(parts[0], "0123456789") != "" {
+				return nil, fmt.Errorf("invalid id %q", parts[0])
+			}
+			return loaderFrom(p.Context).loadOne(table, strings.Join(parts, ";")), nil
+		},
+	}
+}
+
+func newGraphQLSchema() (graphql.Schema, error) {
+	g := &graphqlTypes{objects: make(map[reflect.Type]*graphql.Object)}
+	host := g.object(reflect.TypeOf(Host{}))
+	service := g.object(reflect.TypeOf(Service{}))
+	comment := g.object(reflect.TypeOf(Comment{}))
+	downtime := g.object(reflect.TypeOf(Downtime{}))
+	contact := g.object(reflect.TypeOf(Contact{}))
+	status := g.object(reflect.TypeOf(Status{}))
+
+	for t, rels := range objectRelations {
+		o := g.object(t)
+		for _, rel := range rels {
+			o.AddFieldConfig(rel.name, relationField(g.object(tableTypes[rel.table]), rel))
+		}
+	}
+	// The host field of services is the host itself, so its name needs a
+	// field of its own.
+	service.AddFieldConfig("host_name", &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+		return p.Source.(Service).HostName, nil
+	}})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"hosts":     listField(host, "hosts"),
+			"host":      objectField(host, "hosts", "name"),
+			"services":  listField(service, "services"),
+			"service":   objectField(service, "services", "host_name", "description"),
+			"comments":  listField(comment, "comments"),
+			"comment":   objectField(comment, "comments", "id"),
+			"downtimes": listField(downtime, "downtimes"),
+			"downtime":  objectField(downtime, "downtimes", "id"),
+			"contacts":  listField(contact, "contacts"),
+			"contact":   objectField(contact, "contacts", "name"),
+			"status": &graphql.Field{
+				Type: status,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return findStatus()
+				},
+			},
+		},
+	})
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query})
+}
+
+// graphqlRequest is a GraphQL operation as POSTed to /graphql.
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// serveGraphQL runs a GraphQL query from the query parameters of a GET or
+// the body of a POST, which may also be a list of operations to run
+// together. Operations in one request share their lookups.
+func serveGraphQL(w http.ResponseWriter, r *http.Request) {
+	var reqs []graphqlRequest
+	batch := false
+
+	if r.Method == http.MethodGet {
+		req := graphqlRequest{Query: r.URL.Query().Get("query"), OperationName: r.URL.Query().Get("operationName")}
+		if v := r.URL.Query().Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		reqs = append(reqs, req)
+	} else {
+		var body json.RawMessage
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, graphqlMaxBody)).Decode(&body); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("the body may hold at most %d bytes", graphqlMaxBody))
+				return
+			}
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var err error
+		if batch = strings.HasPrefix(strings.TrimSpace(string(body)), "["); batch {
+			err = json.Unmarshal(body, &reqs)
+		} else {
+			reqs = make([]graphqlRequest, 1)
+			err = json.Unmarshal(body, &reqs[0])
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if len(reqs) > graphqlMaxBatch {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("at most %d operations may be batched", graphqlMaxBatch))
+		return
+	}
+	for _, req := range reqs {
+		if req.Query == "" {
+			writeError(w, http.StatusBadRequest, "a query is required")
+			return
+		}
+		if queryDepth(req.Query) > graphqlMaxDepth {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("fields may nest at most %d deep", graphqlMaxDepth))
+			return
+		}
+	}
+
+	ctx := context.WithValue(r.Context(), objectLoaderKey{}, newObjectLoader())
+	results := make([]*graphql.Result, len(reqs))
+	for i, req := range reqs {
+		results[i] = graphql.Do(graphql.Params{
+			Schema:         graphqlSchema,
+			RequestString:  req.Query,
+			OperationName:  req.OperationName,
+			VariableValues: req.Variables,
+			Context:        ctx,
+		})
+	}
+
+	if batch {
+		writeJSON(w, r, results)
+	} else {
+		writeJSON(w, r, results[0])
+	}
+}
+
+// queryDepth returns how deeply the fields of query nest, following
+// fragments. Queries that do not parse count as flat and fail later with
+// a proper error.
+func queryDepth(query string) int {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return 0
+	}
+	fragments := make(map[string]*ast.FragmentDefinition)
+	for _, def := range doc.Definitions {
+		if f, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[f.Name.Value] = f
+		}
+	}
+
+	// Fragments being expanded are skipped, so cycles end.
+	expanding := make(map[string]bool)
+	var depth func(set *ast.SelectionSet) int
+	depth = func(set *ast.SelectionSet) int {
+		if set == nil {
+			return 0
+		}
+		deepest := 0
+		for _, sel := range set.Selections {
+			d := 0
+			switch sel := sel.(type) {
+			case *ast.Field:
+				d = 1 + depth(sel.SelectionSet)
+			case *ast.InlineFragment:
+				d = depth(sel.SelectionSet)
+			case *ast.FragmentSpread:
+				if f := fragments[sel.Name.Value]; f != nil && !expanding[f.Name.Value] {
+					expanding[f.Name.Value] = true
+					d = depth(f.SelectionSet)
+					delete(expanding, f.Name.Value)
+				}
+			}
+			deepest = max(deepest, d)
+		}
+		return deepest
+	}
+
+	deepest := 0
+	for _, def := range doc.Definitions {
+		if op, ok := def.(*ast.OperationDefinition); ok {
+			deepest = max(deepest, depth(op.SelectionSet))
+		}
+	}
+	return deepest
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGraphQL(t *testing.T) {
+	startMock(t, testTables())
+
+	q := `{ host(name: "web01") { state services { description host { name } } comments { author } } }`
+	rec := serve("GET", "/graphql?query="+url.QueryEscape(q), "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var got interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]interface{}{
+		"data.host.state":                  1.0,
+		"data.host.services.0.description": "HTTP",
+		"data.host.services.0.host.name":   "web01",
+		"data.host.comments.0.author":      "alice",
+	} {
+		if v := jsonPath(got, path); v != want {
+			t.Errorf("%s = %v, want %v", path, v, want)
+		}
+	}
+	if rec.Header().Get("ETag") == "" {
+		t.Error("no ETag")
+	}
+}
+
+func TestGraphQLQueriesPerTable(t *testing.T) {
+	m := startMock(t, testTables())
+
+	// Each operation lists the hosts itself, but related objects are fetched
+	// once per table for both.
+	body := `[
+		{"query": "{ hosts { name services { description } comments { author } downtimes { id } contacts { name } } }"},
+		{"query": "{ hosts { services { description } } }"}
+	]`
+	rec := serve("POST", "/graphql", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var got interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if v := jsonPath(got, "0.data.hosts.0.comments.0.author"); v != "alice" {
+		t.Errorf("comment author = %v: %s", v, rec.Body)
+	}
+	for table, want := range map[string]int{"hosts": 2, "services": 1, "comments": 1, "downtimes": 1, "contacts": 1} {
+		if n := m.queryCount(table); n != want {
+			t.Errorf("%d queries of %s, want %d", n, table, want)
+		}
+	}
+}
+
+func TestGraphQLLimits(t *testing.T) {
+	startMock(t, testTables())
+
+	ops := make([]string, graphqlMaxBatch+1)
+	for i := range ops {
+		ops[i] = `{"query": "{ status { program_version } }"}`
+	}
+	deep := "{ hosts { name } }"
+	for i := 0; i < graphqlMaxDepth; i++ {
+		deep = strings.Replace(deep, "{ name }", "{ name parents { name } }", 1)
+	}
+	cyclic := "query { hosts { ...a } } fragment a on Host { parents { ...a } }"
+
+	for _, tc := range []struct {
+		name string
+		body string
+		code int
+	}{
+		{"batch", "[" + strings.Join(ops[1:], ",") + "]", http.StatusOK},
+		{"batch too large", "[" + strings.Join(ops, ",") + "]", http.StatusBadRequest},
+		{"too deep", fmt.Sprintf(`{"query": %q}`, deep), http.StatusBadRequest},
+		{"cyclic fragment", fmt.Sprintf(`{"query": %q}`, cyclic), http.StatusOK},
+		{"body too large", fmt.Sprintf(`{"query": "{ status { program_version } }", "operationName": %q}`, strings.Repeat("x", graphqlMaxBody)), http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if rec := serve("POST", "/graphql", tc.body); rec.Code != tc.code {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tc.code, rec.Body)
+			}
+		})
+	}
+}
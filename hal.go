@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// halLink is a HAL link object.
+type halLink struct {
+	Href string `json:"href"`
+}
+
+// halView renders hosts, services, comments, downtimes and contacts in the
+// HAL representation: their fields plus _links to themselves and the
+// objects their relations refer to, and _embedded copies of the related
+// objects in include.
+type halView struct {
+	include []string
+	loader  *objectLoader
+}
+
+// parseHAL returns the HAL view r asked for, or nil. HAL is chosen with an
+// Accept of application/hal+json or by asking for related objects with
+// include, a comma separated list of relation names.
+func parseHAL(w http.ResponseWriter, r *http.Request) *halView {
+	varyAccept(w)
+
+	include := listParam(r, "include")
+	hal := len(include) > 0
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if t, _, err := mime.ParseMediaType(accept); err == nil && t == "application/hal+json" {
+			hal = true
+		}
+	}
+	if !hal {
+		return nil
+	}
+	return &halView{include: include, loader: newObjectLoader()}
+}
+
+// objectKey returns the table and key of v if it is an object of a table,
+// see queryTable.
+func objectKey(v interface{}) (string, string, bool) {
+	switch o := v.(type) {
+	case Host:
+		return "hosts", hostKey(&o), true
+	case Service:
+		return "services", serviceKey(&o), true
+	case Comment:
+		return "comments", commentKey(&o), true
+	case Downtime:
+		return "downtimes", downtimeKey(&o), true
+	case Contact:
+		return "contacts", o.Name, true
+	}
+	return "", "", false
+}
+
+// objects returns the objects in v, which may be an object, a pointer to one
+// or a list of them.
+func objects(v interface{}) []interface{} {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil
+		}
+		return objects(rv.Elem().Interface())
+	case reflect.Slice:
+		var objs []interface{}
+		for i := 0; i < rv.Len(); i++ {
+			objs = append(objs, objects(rv.Index(i).Interface())...)
+		}
+		return objs
+	}
+	if _, _, ok := objectKey(v); ok {
+		return []interface{}{v}
+	}
+	return nil
+}
+
+// relation returns the relation of v's type called name.
+func relation(v interface{}, name string) (objectRelation, bool) {
+	for _, rel := range objectRelations[reflect.TypeOf(v)] {
+		if rel.name == name {
+			return rel, true
+		}
+	}
+	return objectRelation{}, false
+}
+
+// check returns an error if an object in v has no relation of a name in
+// include.
+func (h *halView) check(v interface{}) error {
+	for _, o := range objects(v) {
+		for _, name := range h.include {
+			if _, ok := relation(o, name); !ok {
+				table, _, _ := objectKey(o)
+				return fmt.Errorf("%s have no relation %q", table, name)
+			}
+		}
+	}
+	return nil
+}
+
+// load fetches the objects to embed in v, with one query per table. Objects
+// in v itself need none.
+func (h *halView) load(v interface{}) error {
+	objs := objects(v)
+	for _, o := range objs {
+		table, key, _ := objectKey(o)
+		h.loader.add(table, []interface{}{o}, []string{key})
+	}
+	for _, o := range objs {
+		for _, name := range h.include {
+			rel, _ := relation(o, name)
+			h.loader.load(rel.table, rel.keys(o))
+		}
+	}
+	for table := range h.loader.pending {
+		if err := h.loader.flush(table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decorate adds the _links and _embedded members of o to its fields m.
+// Embedded objects have links but embed nothing themselves.
+func (h *halView) decorate(m map[string]interface{}, o interface{}, loc *time.Location) {
+	table, key, _ := objectKey(o)
+	links := map[string]interface{}{"self": halLink{objectURL(table, key)}}
+	for _, rel := range objectRelations[reflect.TypeOf(o)] {
+		keys := rel.keys(o)
+		if rel.one {
+			if len(keys) > 0 {
+				links[rel.name] = halLink{objectURL(rel.table, keys[0])}
+			}
+			continue
+		}
+		list := make([]halLink, len(keys))
+		for i, k := range keys {
+			list[i] = halLink{objectURL(rel.table, k)}
+		}
+		links[rel.name] = list
+	}
+	m["_links"] = links
+
+	if len(h.include) == 0 {
+		return
+	}
+	embedded := make(map[string]interface{})
+	for _, name := range h.include {
+		rel, _ := relation(o, name)
+		objs, _ := h.loader.load(rel.table, rel.keys(o))()
+		if !rel.one {
+			embedded[name] = represent(objs, loc, &halView{})
+		} else if list := objs.([]interface{}); len(list) > 0 {
+			embedded[name] = represent(list[0], loc, &halView{})
+		} else {
+			embedded[name] = nil
+		}
+	}
+	m["_embedded"] = embedded
+}
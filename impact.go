@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// impactHostColumns and impactServiceColumns are the columns of the impact
+// graph. depends_exec and depends_notify are Naemon's execution and
+// notification dependencies, host names for hosts and host and description
+// pairs for services.
+const (
+	impactHostColumns    = "name state has_been_checked parents depends_exec depends_notify"
+	impactServiceColumns = "host_name description state has_been_checked depends_exec depends_notify"
+)
+
+// impactObject is a host or service in the impact graph.
+type impactObject struct {
+	HostName    string
+	Description string
+	State       int
+	Checked     bool
+	Parents     []string
+	// Depends holds the keys of the objects this one depends on, in the form
+	// of hostKey and serviceKey.
+	Depends []string
+}
+
+type impactHost struct{ impactObject }
+
+func (h *impactHost) UnmarshalJSON(b []byte) (err error) {
+	var tmp []interface{}
+
+	if err := json.Unmarshal(b, &tmp); err != nil {
+		return err
+	}
+
+	h.HostName = tmp[0].(string)
+	h.State = int(tmp[1].(float64))
+	h.Checked = tmp[2].(float64) != 0
+	for _, p := range tmp[3].([]interface{}) {
+		h.Parents = append(h.Parents, p.(string))
+	}
+	h.Depends = dependencyKeys(tmp[4:6])
+
+	return nil
+}
+
+type impactService struct{ impactObject }
+
+func (s *impactService) UnmarshalJSON(b []byte) (err error) {
+	var tmp []interface{}
+
+	if err := json.Unmarshal(b, &tmp); err != nil {
+		return err
+	}
+
+	s.HostName = tmp[0].(string)
+	s.Description = tmp[1].(string)
+	s.State = int(tmp[2].(float64))
+	s.Checked = tmp[3].(float64) != 0
+	s.Depends = dependencyKeys(tmp[4:6])
+
+	return nil
+}
+
+// dependencyKeys merges dependency columns into one list of keys.
+func dependencyKeys(cols []interface{}) []string {
+	keys := []string{}
+	seen := make(map[string]bool)
+	for _, col := range cols {
+		for _, d := range col.([]interface{}) {
+			var key string
+			switch d := d.(type) {
+			case string:
+				key = d
+			case []interface{}:
+				if len(d) != 2 {
+					continue
+				}
+				key = d[0].(string) + ";" + d[1].(string)
+			}
+			if key != "" && !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+func (o *impactObject) key() string {
+	if o.Description != "" {
+		return o.HostName + ";" + o.Description
+	}
+	return o.HostName
+}
+
+// problem reports whether o is currently in a non-OK state.
+func (o *impactObject) problem() bool {
+	return o.Checked && o.State != 0
+}
+
+// impactGraph links each host and service to the objects a failure of it
+// affects: a host's children and services, and everything that depends on
+// it.
+type impactGraph struct {
+	objects    map[string]*impactObject
+	downstream map[string][]string
+	upstream   map[string][]string
+}
+
+func loadImpactGraph() (*impactGraph, error) {
+	var hosts []impactHost
+	var services []impactService
+
+	raw, err := query("GET hosts\nColumns: " + impactHostColumns)
+	if err != nil {
+		return nil, err
+	}
+	err = json.NewDecoder(raw).Decode(&hosts)
+	raw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err = query("GET services\nColumns: " + impactServiceColumns)
+	if err != nil {
+		return nil, err
+	}
+	err = json.NewDecoder(raw).Decode(&services)
+	raw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	g := &impactGraph{
+		objects:    make(map[string]*impactObject, len(hosts)+len(services)),
+		downstream: make(map[string][]string),
+		upstream:   make(map[string][]string),
+	}
+	for i := range hosts {
+		g.objects[hosts[i].key()] = &hosts[i].impactObject
+	}
+	for i := range services {
+		g.objects[services[i].key()] = &services[i].impactObject
+	}
+	for _, o := range g.objects {
+		// A host takes down its children and its own services.
+		for _, p := range o.Parents {
+			g.link(p, o.key())
+		}
+		if o.Description != "" {
+			g.link(o.HostName, o.key())
+		}
+		for _, d := range o.Depends {
+			g.link(d, o.key())
+		}
+	}
+	return g, nil
+}
+
+func (g *impactGraph) link(from, to string) {
+	g.downstream[from] = append(g.downstream[from], to)
+	g.upstream[to] = append(g.upstream[to], from)
+}
+
+// ImpactedObject is a host or service reached while walking the impact
+// graph.
+type ImpactedObject struct {
+	HostName           string `json:"host_name"`
+	ServiceDescription string `json:"service_description,omitempty"`
+	State              int    `json:"state"`
+	// Problem is set if the object is currently not OK.
+	Problem bool `json:"problem"`
+	// Depth is how many links away from the starting object this one is.
+	Depth int `json:"depth"`
+	// Via is the host name or host;service it was reached through.
+	Via string `json:"via,omitempty"`
+}
+
+func (o *ImpactedObject) key() string {
+	if o.ServiceDescription != "" {
+		return o.HostName + ";" + o.ServiceDescription
+	}
+	return o.HostName
+}
+
+func (g *impactGraph) impacted(key string, depth int, via string) ImpactedObject {
+	o := g.objects[key]
+	return ImpactedObject{
+		HostName:           o.HostName,
+		ServiceDescription: o.Description,
+		State:              o.State,
+		Problem:            o.problem(),
+		Depth:              depth,
+		Via:                via,
+	}
+}
+
+// walk visits the objects reachable from key through links, breadth first,
+// following only those follow allows. It returns them in the order visited,
+// without key itself.
+func (g *impactGraph) walk(key string, links map[string][]string, follow func(o *impactObject) bool) []ImpactedObject {
+	var out []ImpactedObject
+	seen := map[string]bool{key: true}
+	queue := []ImpactedObject{g.impacted(key, 0, "")}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		curKey := cur.key()
+
+		next := append([]string(nil), links[curKey]...)
+		sort.Strings(next)
+		for _, k := range next {
+			if seen[k] || g.objects[k] == nil || !follow(g.objects[k]) {
+				continue
+			}
+			seen[k] = true
+			o := g.impacted(k, cur.Depth+1, curKey)
+			out = append(out, o)
+			queue = append(queue, o)
+		}
+	}
+	return out
+}
+
+// ImpactResponse lists what a host's failure does or would affect.
+type ImpactResponse struct {
+	HostName string           `json:"host_name"`
+	Hosts    []ImpactedObject `json:"hosts"`
+	Services []ImpactedObject `json:"services"`
+}
+
+func getHostImpact(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	g, err := loadImpactGraph()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if g.objects[vars["name"]] == nil {
+		writeError(w, http.StatusNotFound, "Host not found")
+		return
+	}
+
+	resp := ImpactResponse{HostName: vars["name"], Hosts: []ImpactedObject{}, Services: []ImpactedObject{}}
+	all := func(*impactObject) bool { return true }
+	for _, o := range g.walk(vars["name"], g.downstream, all) {
+		if o.ServiceDescription != "" {
+			resp.Services = append(resp.Services, o)
+		} else {
+			resp.Hosts = append(resp.Hosts, o)
+		}
+	}
+	writeJSON(w, r, resp)
+}
+
+// RootCauseResponse explains a problem by the failing objects it depends on.
+type RootCauseResponse struct {
+	Problem ImpactedObject `json:"problem"`
+	// RootCauses are the failing objects upstream of Problem that do not
+	// depend on anything failing themselves. If nothing upstream is failing,
+	// Problem is its own root cause.
+	RootCauses []ImpactedObject `json:"root_causes"`
+	// Path leads from Problem to the nearest root cause.
+	Path []ImpactedObject `json:"path"`
+}
+
+// rootCause walks up from key through failing objects only.
+func (g *impactGraph) rootCause(key string) RootCauseResponse {
+	failing := func(o *impactObject) bool { return o.problem() }
+
+	resp := RootCauseResponse{Problem: g.impacted(key, 0, ""), RootCauses: []ImpactedObject{}}
+	visited := map[string]ImpactedObject{key: resp.Problem}
+	for _, o := range g.walk(key, g.upstream, failing) {
+		visited[o.key()] = o
+
+		root := true
+		for _, u := range g.upstream[o.key()] {
+			if g.objects[u] != nil && failing(g.objects[u]) {
+				root = false
+				break
+			}
+		}
+		if root {
+			resp.RootCauses = append(resp.RootCauses, o)
+		}
+	}
+	if len(resp.RootCauses) == 0 {
+		resp.RootCauses = append(resp.RootCauses, resp.Problem)
+	}
+
+	// The walk is breadth first, so the first root cause is the nearest.
+	for o := resp.RootCauses[0]; ; o = visited[o.Via] {
+		resp.Path = append(resp.Path, o)
+		if o.Via == "" {
+			break
+		}
+	}
+	slices.Reverse(resp.Path)
+	return resp
+}
+
+func getHostRootCause(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	writeRootCause(w, r, vars["name"], "Host not found")
+}
+
+func getServiceRootCause(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	writeRootCause(w, r, vars["host_name"]+";"+vars["name"], "Service not found")
+}
+
+func writeRootCause(w http.ResponseWriter, r *http.Request, key, notFound string) {
+	g, err := loadImpactGraph()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if g.objects[key] == nil {
+		writeError(w, http.StatusNotFound, notFound)
+		return
+	}
+
+	writeJSON(w, r, g.rootCause(key))
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -26,8 +28,52 @@ var (
 		"socket-path", "/var/cache/naemon/live",
 		"Path for Livestatus UNIX socket.",
 	)
+	watchInterval = flag.Duration(
+		"watch.interval", 5*time.Second,
+		"How often hosts and services are polled for changes while websocket clients are subscribed or webhooks are configured.",
+	)
+	webhookConfig = flag.String(
+		"webhooks.config", "",
+		"Path to a JSON file configuring webhooks for state transitions.",
+	)
+	cacheRefresh = flag.Duration(
+		"cache.refresh-interval", 0,
+		"How often hosts, services, downtimes and comments are re-read when serving them from memory. 0 disables the cache.",
+	)
+	metricsHostSeries = flag.Bool(
+		"metrics.host-series", true,
+		"Expose per-host series on /metrics.",
+	)
+	metricsServiceSeries = flag.Bool(
+		"metrics.service-series", true,
+		"Expose per-service series on /metrics.",
+	)
+	metricsGroupLabels = flag.Bool(
+		"metrics.group-labels", false,
+		"Add a groups label to per-host and per-service series on /metrics.",
+	)
+	perfDataPushURL = flag.String(
+		"perfdata.push-url", "",
+		"InfluxDB write URL (http://host:8086/write?db=naemon) or Graphite address (tcp://host:2003) to periodically push service perfdata to.",
+	)
+	perfDataPushInterval = flag.Duration(
+		"perfdata.push-interval", time.Minute,
+		"How often perfdata is pushed to -perfdata.push-url.",
+	)
+	reprTimezone = flag.String(
+		"repr.timezone", "Local",
+		"Time zone of timestamps in the human representation (repr=human).",
+	)
+	wsAllowedOrigins = flag.String(
+		"ws.allowed-origins", "",
+		"Comma separated origins (https://dashboard.example.com) whose pages may open websockets, besides the API's own.",
+	)
 )
 
+// commentColumns lists the comments table columns in the order
+// Comment.UnmarshalJSON expects them.
+const commentColumns = "id author comment entry_time entry_type expire_time expires type host_name service_description"
+
 type Comment struct {
 	ID                 int    `json:"id"`
 	Author             string `json:"author"`
@@ -63,6 +109,10 @@ func (c *Comment) UnmarshalJSON(b []byte) (err error) {
 	return nil
 }
 
+// contactColumns lists the contacts table columns in the order
+// Contact.UnmarshalJSON expects them.
+const contactColumns = "id name alias email pager host_notification_period host_notifications_enabled service_notification_period service_notifications_enabled"
+
 type Contact struct {
 	ID                          int    `json:"id"`
 	Name                        string `json:"name"`
@@ -96,6 +146,10 @@ func (c *Contact) UnmarshalJSON(b []byte) (err error) {
 	return nil
 }
 
+// downtimeColumns lists the downtimes table columns in the order
+// Downtime.UnmarshalJSON expects them.
+const downtimeColumns = "id author comment duration start_time end_time entry_time fixed type host_name service_description"
+
 type Downtime struct {
 	ID                 int    `json:"id"`
 	Author             string `json:"author"`
@@ -133,6 +187,10 @@ func (d *Downtime) UnmarshalJSON(b []byte) (err error) {
 	return nil
 }
 
+// hostColumns lists the hosts table columns in the order Host.UnmarshalJSON
+// expects them.
+const hostColumns = "id name alias acknowledged address check_period check_source checks_enabled comments contacts downtimes event_handler event_handler_enabled execution_time flap_detection_enabled groups hard_state has_been_checked in_check_period in_notification_period is_flapping last_check last_notification last_state_change last_time_down last_time_unreachable last_time_up latency next_check next_notification notification_period notifications_enabled num_services num_services_hard_crit num_services_hard_ok num_services_hard_unknown num_services_hard_warn num_services_pending state state_type services perf_data plugin_output long_plugin_output notes notes_url action_url icon_image display_name custom_variable_names custom_variable_values parents childs percent_state_change check_interval retry_interval check_command"
+
 type Host struct {
 	ID                         int      `json:"id"`
 	Name                       string   `json:"name"`
@@ -147,7 +205,7 @@ type Host struct {
 	Downtimes                  []int    `json:"downtimes"`
 	EventHandler               string   `json:"event_handler"`
 	EventHandlerEnabled        bool     `json:"event_handler_enabled"`
-	ExecutionTime              int      `json:"execution_time"`
+	ExecutionTime              float64  `json:"execution_time"`
 	FlapDetectionEnabled       bool     `json:"flap_detection_enabled"`
 	Groups                     []string `json:"groups"`
 	HardState                  int      `json:"hard_state"`
@@ -161,7 +219,7 @@ type Host struct {
 	LastTimeDown               int      `json:"last_time_down"`
 	LastTimeUnreachable        int      `json:"last_time_unreachable"`
 	LastTimeUp                 int      `json:"last_time_up"`
-	Latency                    int      `json:"latency"`
+	Latency                    float64  `json:"latency"`
 	NextCheck                  int      `json:"next_check"`
 	NextNotification           int      `json:"next_notification"`
 	NotificationPeriod         string   `json:"notification_period"`
@@ -175,6 +233,26 @@ type Host struct {
 	State                      int      `json:"state"`
 	StateType                  int      `json:"state_type"`
 	Services                   []string `json:"services"`
+	PerfData                   string   `json:"perf_data"`
+	PluginOutput               string   `json:"plugin_output"`
+	LongPluginOutput           string   `json:"long_plugin_output"`
+	Notes                      string   `json:"notes"`
+	NotesURL                   string   `json:"notes_url"`
+	ActionURL                  string   `json:"action_url"`
+	IconImage                  string   `json:"icon_image"`
+	DisplayName                string   `json:"display_name"`
+	CustomVariableNames        []string `json:"-"`
+	CustomVariableValues       []string `json:"-"`
+	Parents                    []string `json:"parents"`
+	Children                   []string `json:"children"`
+	PercentStateChange         float64  `json:"percent_state_change"`
+	CheckInterval              float64  `json:"check_interval"`
+	RetryInterval              float64  `json:"retry_interval"`
+	CheckCommand               string   `json:"check_command"`
+	// Metrics is PerfData parsed.
+	Metrics []PerfMetric `json:"metrics"`
+	// CustomVariables pairs up CustomVariableNames and CustomVariableValues.
+	CustomVariables map[string]string `json:"custom_variables"`
 }
 
 func (h *Host) UnmarshalJSON(b []byte) (err error) {
@@ -207,7 +285,7 @@ func (h *Host) UnmarshalJSON(b []byte) (err error) {
 	}
 	h.EventHandler = tmp[11].(string)
 	h.EventHandlerEnabled = tmp[12].(float64) != 0
-	h.ExecutionTime = int(tmp[13].(float64))
+	h.ExecutionTime = tmp[13].(float64)
 	h.FlapDetectionEnabled = tmp[14].(float64) != 0
 	h.Groups = make([]string, len(tmp[15].([]interface{})))
 	for i := range tmp[15].([]interface{}) {
@@ -224,7 +302,7 @@ func (h *Host) UnmarshalJSON(b []byte) (err error) {
 	h.LastTimeDown = int(tmp[24].(float64))
 	h.LastTimeUnreachable = int(tmp[25].(float64))
 	h.LastTimeUp = int(tmp[26].(float64))
-	h.Latency = int(tmp[27].(float64))
+	h.Latency = tmp[27].(float64)
 	h.NextCheck = int(tmp[28].(float64))
 	h.NextNotification = int(tmp[29].(float64))
 	h.NotificationPeriod = tmp[30].(string)
@@ -241,10 +319,44 @@ func (h *Host) UnmarshalJSON(b []byte) (err error) {
 	for i := range tmp[40].([]interface{}) {
 		h.Services[i] = tmp[40].([]interface{})[i].(string)
 	}
+	h.PerfData = tmp[41].(string)
+	h.PluginOutput = tmp[42].(string)
+	h.LongPluginOutput = tmp[43].(string)
+	h.Notes = tmp[44].(string)
+	h.NotesURL = tmp[45].(string)
+	h.ActionURL = tmp[46].(string)
+	h.IconImage = tmp[47].(string)
+	h.DisplayName = tmp[48].(string)
+	h.CustomVariableNames = make([]string, len(tmp[49].([]interface{})))
+	for i := range tmp[49].([]interface{}) {
+		h.CustomVariableNames[i] = tmp[49].([]interface{})[i].(string)
+	}
+	h.CustomVariableValues = make([]string, len(tmp[50].([]interface{})))
+	for i := range tmp[50].([]interface{}) {
+		h.CustomVariableValues[i] = tmp[50].([]interface{})[i].(string)
+	}
+	h.Parents = make([]string, len(tmp[51].([]interface{})))
+	for i := range tmp[51].([]interface{}) {
+		h.Parents[i] = tmp[51].([]interface{})[i].(string)
+	}
+	h.Children = make([]string, len(tmp[52].([]interface{})))
+	for i := range tmp[52].([]interface{}) {
+		h.Children[i] = tmp[52].([]interface{})[i].(string)
+	}
+	h.PercentStateChange = tmp[53].(float64)
+	h.CheckInterval = tmp[54].(float64)
+	h.RetryInterval = tmp[55].(float64)
+	h.CheckCommand = tmp[56].(string)
+	h.CustomVariables = customVariables(h.CustomVariableNames, h.CustomVariableValues)
+	h.Metrics = parsePerfData(h.PerfData)
 
 	return nil
 }
 
+// serviceColumns lists the services table columns in the order
+// Service.UnmarshalJSON expects them.
+const serviceColumns = "id acknowledged check_period check_source check_type checks_enabled comments contacts description downtimes event_handler event_handler_enabled execution_time flap_detection_enabled groups has_been_checked in_check_period in_notification_period is_flapping last_check last_notification last_state_change last_time_critical last_time_ok last_time_unknown last_time_warning latency next_check next_notification notification_period notifications_enabled state state_type host_name perf_data plugin_output long_plugin_output notes notes_url action_url icon_image display_name custom_variable_names custom_variable_values percent_state_change check_interval retry_interval check_command"
+
 type Service struct {
 	ID                   int      `json:"id"`
 	Acknowledged         bool     `json:"acknowledged"`
@@ -258,7 +370,7 @@ type Service struct {
 	Downtimes            []int    `json:"downtimes"`
 	EventHandler         string   `json:"event_handler"`
 	EventHandlerEnabled  bool     `json:"event_handler_enabled"`
-	ExecutionTime        int      `json:"execution_time"`
+	ExecutionTime        float64  `json:"execution_time"`
 	FlapDetectionEnabled bool     `json:"flap_detection_enabled"`
 	Groups               []string `json:"groups"`
 	HasBeenChecked       bool     `json:"has_been_checked"`
@@ -272,7 +384,7 @@ type Service struct {
 	LastTimeOK           int      `json:"last_time_ok"`
 	LastTimeUnknown      int      `json:"last_time_unknown"`
 	LastTimeWarning      int      `json:"last_time_warning"`
-	Latency              int      `json:"latency"`
+	Latency              float64  `json:"latency"`
 	NextCheck            int      `json:"next_check"`
 	NextNotification     int      `json:"next_notification"`
 	NotificationPeriod   string   `json:"notification_period"`
@@ -280,6 +392,24 @@ type Service struct {
 	State                int      `json:"state"`
 	StateType            int      `json:"state_type"`
 	HostName             string   `json:"host"`
+	PerfData             string   `json:"perf_data"`
+	PluginOutput         string   `json:"plugin_output"`
+	LongPluginOutput     string   `json:"long_plugin_output"`
+	Notes                string   `json:"notes"`
+	NotesURL             string   `json:"notes_url"`
+	ActionURL            string   `json:"action_url"`
+	IconImage            string   `json:"icon_image"`
+	DisplayName          string   `json:"display_name"`
+	CustomVariableNames  []string `json:"-"`
+	CustomVariableValues []string `json:"-"`
+	PercentStateChange   float64  `json:"percent_state_change"`
+	CheckInterval        float64  `json:"check_interval"`
+	RetryInterval        float64  `json:"retry_interval"`
+	CheckCommand         string   `json:"check_command"`
+	// Metrics is PerfData parsed.
+	Metrics []PerfMetric `json:"metrics"`
+	// CustomVariables pairs up CustomVariableNames and CustomVariableValues.
+	CustomVariables map[string]string `json:"custom_variables"`
 }
 
 func (s *Service) UnmarshalJSON(b []byte) (err error) {
@@ -311,7 +441,7 @@ func (s *Service) UnmarshalJSON(b []byte) (err error) {
 	}
 	s.EventHandler = tmp[10].(string)
 	s.EventHandlerEnabled = tmp[11].(float64) != 0
-	s.ExecutionTime = int(tmp[12].(float64))
+	s.ExecutionTime = tmp[12].(float64)
 	s.FlapDetectionEnabled = tmp[13].(float64) != 0
 	s.Groups = make([]string, len(tmp[14].([]interface{})))
 	for i := range tmp[14].([]interface{}) {
@@ -328,7 +458,7 @@ func (s *Service) UnmarshalJSON(b []byte) (err error) {
 	s.LastTimeOK = int(tmp[23].(float64))
 	s.LastTimeUnknown = int(tmp[24].(float64))
 	s.LastTimeWarning = int(tmp[25].(float64))
-	s.Latency = int(tmp[26].(float64))
+	s.Latency = tmp[26].(float64)
 	s.NextCheck = int(tmp[27].(float64))
 	s.NextNotification = int(tmp[28].(float64))
 	s.NotificationPeriod = tmp[29].(string)
@@ -336,16 +466,138 @@ func (s *Service) UnmarshalJSON(b []byte) (err error) {
 	s.State = int(tmp[31].(float64))
 	s.StateType = int(tmp[32].(float64))
 	s.HostName = tmp[33].(string)
+	s.PerfData = tmp[34].(string)
+	s.PluginOutput = tmp[35].(string)
+	s.LongPluginOutput = tmp[36].(string)
+	s.Notes = tmp[37].(string)
+	s.NotesURL = tmp[38].(string)
+	s.ActionURL = tmp[39].(string)
+	s.IconImage = tmp[40].(string)
+	s.DisplayName = tmp[41].(string)
+	s.CustomVariableNames = make([]string, len(tmp[42].([]interface{})))
+	for i := range tmp[42].([]interface{}) {
+		s.CustomVariableNames[i] = tmp[42].([]interface{})[i].(string)
+	}
+	s.CustomVariableValues = make([]string, len(tmp[43].([]interface{})))
+	for i := range tmp[43].([]interface{}) {
+		s.CustomVariableValues[i] = tmp[43].([]interface{})[i].(string)
+	}
+	s.PercentStateChange = tmp[44].(float64)
+	s.CheckInterval = tmp[45].(float64)
+	s.RetryInterval = tmp[46].(float64)
+	s.CheckCommand = tmp[47].(string)
+	s.CustomVariables = customVariables(s.CustomVariableNames, s.CustomVariableValues)
+	s.Metrics = parsePerfData(s.PerfData)
+
+	return nil
+}
+
+// logColumns lists the log table columns in the order LogEntry.UnmarshalJSON
+// expects them.
+const logColumns = "time lineno class type state state_type host_name service_description plugin_output comment contact_name options message"
+
+type LogEntry struct {
+	Time               int    `json:"time"`
+	LineNumber         int    `json:"lineno"`
+	Class              int    `json:"class"`
+	Type               string `json:"type"`
+	State              int    `json:"state"`
+	StateType          string `json:"state_type"`
+	HostName           string `json:"host_name"`
+	ServiceDescription string `json:"service_description"`
+	PluginOutput       string `json:"plugin_output"`
+	Comment            string `json:"comment"`
+	ContactName        string `json:"contact_name"`
+	Options            string `json:"options"`
+	Message            string `json:"message"`
+}
+
+func (l *LogEntry) UnmarshalJSON(b []byte) (err error) {
+	var tmp []interface{}
+	err = json.Unmarshal(b, &tmp)
+	if err != nil {
+		return err
+	}
+
+	l.Time = int(tmp[0].(float64))
+	l.LineNumber = int(tmp[1].(float64))
+	l.Class = int(tmp[2].(float64))
+	l.Type = tmp[3].(string)
+	l.State = int(tmp[4].(float64))
+	l.StateType = tmp[5].(string)
+	l.HostName = tmp[6].(string)
+	l.ServiceDescription = tmp[7].(string)
+	l.PluginOutput = tmp[8].(string)
+	l.Comment = tmp[9].(string)
+	l.ContactName = tmp[10].(string)
+	l.Options = tmp[11].(string)
+	l.Message = tmp[12].(string)
+
+	return nil
+}
+
+// statusColumns lists the status table columns in the order
+// Status.UnmarshalJSON expects them.
+const statusColumns = "program_version program_start nagios_pid livestatus_version enable_notifications execute_service_checks execute_host_checks accept_passive_service_checks accept_passive_host_checks enable_event_handlers enable_flap_detection process_performance_data check_service_freshness check_host_freshness obsess_over_services obsess_over_hosts"
+
+type Status struct {
+	ProgramVersion             string `json:"program_version"`
+	ProgramStart               int    `json:"program_start"`
+	PID                        int    `json:"pid"`
+	LivestatusVersion          string `json:"livestatus_version"`
+	EnableNotifications        bool   `json:"enable_notifications"`
+	ExecuteServiceChecks       bool   `json:"execute_service_checks"`
+	ExecuteHostChecks          bool   `json:"execute_host_checks"`
+	AcceptPassiveServiceChecks bool   `json:"accept_passive_service_checks"`
+	AcceptPassiveHostChecks    bool   `json:"accept_passive_host_checks"`
+	EnableEventHandlers        bool   `json:"enable_event_handlers"`
+	EnableFlapDetection        bool   `json:"enable_flap_detection"`
+	ProcessPerformanceData     bool   `json:"process_performance_data"`
+	CheckServiceFreshness      bool   `json:"check_service_freshness"`
+	CheckHostFreshness         bool   `json:"check_host_freshness"`
+	ObsessOverServices         bool   `json:"obsess_over_services"`
+	ObsessOverHosts            bool   `json:"obsess_over_hosts"`
+}
+
+func (s *Status) UnmarshalJSON(b []byte) (err error) {
+	var tmp []interface{}
+	err = json.Unmarshal(b, &tmp)
+	if err != nil {
+		return err
+	}
+
+	s.ProgramVersion = tmp[0].(string)
+	s.ProgramStart = int(tmp[1].(float64))
+	s.PID = int(tmp[2].(float64))
+	s.LivestatusVersion = tmp[3].(string)
+	s.EnableNotifications = tmp[4].(float64) != 0
+	s.ExecuteServiceChecks = tmp[5].(float64) != 0
+	s.ExecuteHostChecks = tmp[6].(float64) != 0
+	s.AcceptPassiveServiceChecks = tmp[7].(float64) != 0
+	s.AcceptPassiveHostChecks = tmp[8].(float64) != 0
+	s.EnableEventHandlers = tmp[9].(float64) != 0
+	s.EnableFlapDetection = tmp[10].(float64) != 0
+	s.ProcessPerformanceData = tmp[11].(float64) != 0
+	s.CheckServiceFreshness = tmp[12].(float64) != 0
+	s.CheckHostFreshness = tmp[13].(float64) != 0
+	s.ObsessOverServices = tmp[14].(float64) != 0
+	s.ObsessOverHosts = tmp[15].(float64) != 0
 
 	return nil
 }
 
 func query(q string) (io.ReadCloser, error) {
+	return queryDeadline(q, time.Now().Add(*timeout))
+}
+
+// queryDeadline is query for requests that may legitimately take longer than
+// the configured timeout, such as those using Livestatus' Wait headers.
+func queryDeadline(q string, deadline time.Time) (io.ReadCloser, error) {
 	f, err := net.DialTimeout("unix", *socket, *timeout)
 	if err != nil {
 		return nil, err
 	}
-	if err := f.SetDeadline(time.Now().Add(*timeout)); err != nil {
+	if err := f.SetDeadline(deadline); err != nil {
 		f.Close()
 		return nil, err
 	}
@@ -360,32 +612,181 @@ func query(q string) (io.ReadCloser, error) {
 	return f, nil
 }
 
-func getComments(w http.ResponseWriter, r *http.Request) {
+// queryHosts returns the hosts matching the given Livestatus filter headers.
+func queryHosts(filters string) ([]Host, error) {
+	var hosts []Host
+
+	raw, err := query("GET hosts\n" + filters + "Columns:" + hostColumns)
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+
+	if err := json.NewDecoder(raw).Decode(&hosts); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// queryServices returns the services matching the given Livestatus filter
+// headers.
+func queryServices(filters string) ([]Service, error) {
+	var services []Service
+
+	raw, err := query("GET services\n" + filters + "Columns:" + serviceColumns)
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+
+	if err := json.NewDecoder(raw).Decode(&services); err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+// queryComments returns the comments matching the given Livestatus filter
+// headers.
+func queryComments(filters string) ([]Comment, error) {
 	var comments []Comment
 
-	raw, err := query("GET comments\nColumns:id author comment entry_time entry_type expire_time expires type host_name service_description")
+	raw, err := query("GET comments\n" + filters + "Columns:" + commentColumns)
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+
+	if err := json.NewDecoder(raw).Decode(&comments); err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+// queryContacts returns the contacts matching the given Livestatus filter
+// headers.
+func queryContacts(filters string) ([]Contact, error) {
+	var contacts []Contact
+
+	raw, err := query("GET contacts\n" + filters + "Columns:" + contactColumns)
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+
+	if err := json.NewDecoder(raw).Decode(&contacts); err != nil {
+		return nil, err
+	}
+	return contacts, nil
+}
+
+// queryDowntimes returns the downtimes matching the given Livestatus filter
+// headers.
+func queryDowntimes(filters string) ([]Downtime, error) {
+	var downtimes []Downtime
+
+	raw, err := query("GET downtimes\n" + filters + "Columns:" + downtimeColumns)
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+
+	if err := json.NewDecoder(raw).Decode(&downtimes); err != nil {
+		return nil, err
+	}
+	return downtimes, nil
+}
+
+// findHost returns the host with the given name, or nil if Livestatus does
+// not know about it.
+func findHost(name string) (*Host, error) {
+	hosts, err := queryHosts(fmt.Sprintf("Filter: name = %s\n", name))
+	if err != nil || len(hosts) == 0 {
+		return nil, err
+	}
+	return &hosts[0], nil
+}
+
+// findService returns the service with the given description on hostName,
+// or nil if Livestatus does not know about it.
+func findService(hostName, name string) (*Service, error) {
+	services, err := queryServices(fmt.Sprintf("Filter: host_name = %s\nFilter: description = %s\n", hostName, name))
+	if err != nil || len(services) == 0 {
+		return nil, err
+	}
+	return &services[0], nil
+}
+
+// findStatus returns the core's program status. The status table always has
+// exactly one row.
+func findStatus() (*Status, error) {
+	var status []Status
+
+	raw, err := query("GET status\nColumns:" + statusColumns)
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+
+	if err := json.NewDecoder(raw).Decode(&status); err != nil {
+		return nil, err
+	}
+	if len(status) == 0 {
+		return nil, errors.New("livestatus returned no status row")
+	}
+	return &status[0], nil
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.WriteHeader(code)
+	w.Write([]byte(fmt.Sprintf("%d - %s", code, msg)))
+}
+
+func getComments(w http.ResponseWriter, r *http.Request) {
+	format, err := parseFormat(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if rows, ok := stateCache.list(w, r, "comments"); ok {
+		writeRows(w, r, "comments", format, rows)
+		return
+	}
+
+	filters, err := parseFilters("comments", r.URL.Query()["filter"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	raw, err := query("GET comments\n" + filters + "Columns:" + commentColumns)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer raw.Close()
 
-	err = json.NewDecoder(raw).Decode(&comments)
-	json.NewEncoder(w).Encode(comments)
+	streamRows(w, r, raw, "comments", format)
 }
 
 func getComment(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	var comments []Comment
 
-	raw, err := query(fmt.Sprintf("GET comments\nFilter: id = %s\nColumns:id author comment entry_time entry_type expire_time expires type host_name service_description", vars["id"]))
+	if row, ok := stateCache.get(w, r, "comments", vars["id"]); ok {
+		writeJSON(w, r, row)
+		return
+	}
+
+	raw, err := query(fmt.Sprintf("GET comments\nFilter: id = %s\nColumns:%s", vars["id"], commentColumns))
 	if err != nil {
-		log.Fatal(err)
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
 	}
 	defer raw.Close()
 
 	err = json.NewDecoder(raw).Decode(&comments)
 	if len(comments) > 0 {
-		json.NewEncoder(w).Encode(comments[0])
+		writeJSON(w, r, comments[0])
 	} else {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("404 - Comment not found"))
@@ -393,31 +794,41 @@ func getComment(w http.ResponseWriter, r *http.Request) {
 }
 
 func getContacts(w http.ResponseWriter, r *http.Request) {
-	var contacts []Contact
+	format, err := parseFormat(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filters, err := parseFilters("contacts", r.URL.Query()["filter"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	raw, err := query("GET contacts\nColumns:id name alias email pager host_notification_period host_notifications_enabled service_notification_period service_notifications_enabled")
+	raw, err := query("GET contacts\n" + filters + "Columns:" + contactColumns)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer raw.Close()
 
-	err = json.NewDecoder(raw).Decode(&contacts)
-	json.NewEncoder(w).Encode(contacts)
+	streamRows(w, r, raw, "contacts", format)
 }
 
 func getContact(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	var contacts []Contact
 
-	raw, err := query(fmt.Sprintf("GET contacts\nFilter: name = %s\nColumns:id name alias email pager host_notification_period host_notifications_enabled service_notification_period service_notifications_enabled", vars["name"]))
+	raw, err := query(fmt.Sprintf("GET contacts\nFilter: name = %s\nColumns:%s", vars["name"], contactColumns))
 	if err != nil {
-		log.Fatal(err)
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
 	}
 	defer raw.Close()
 
 	err = json.NewDecoder(raw).Decode(&contacts)
 	if len(contacts) > 0 {
-		json.NewEncoder(w).Encode(contacts[0])
+		writeJSON(w, r, contacts[0])
 	} else {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("404 - Contact not found"))
@@ -425,31 +836,51 @@ func getContact(w http.ResponseWriter, r *http.Request) {
 }
 
 func getDowntimes(w http.ResponseWriter, r *http.Request) {
-	var downtimes []Downtime
+	format, err := parseFormat(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	raw, err := query("GET downtimes\nColumns:id author comment duration start_time end_time entry_time fixed type host_name service_description")
+	if rows, ok := stateCache.list(w, r, "downtimes"); ok {
+		writeRows(w, r, "downtimes", format, rows)
+		return
+	}
+
+	filters, err := parseFilters("downtimes", r.URL.Query()["filter"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	raw, err := query("GET downtimes\n" + filters + "Columns:" + downtimeColumns)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer raw.Close()
 
-	err = json.NewDecoder(raw).Decode(&downtimes)
-	json.NewEncoder(w).Encode(downtimes)
+	streamRows(w, r, raw, "downtimes", format)
 }
 
 func getDowntime(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	var downtimes []Downtime
 
-	raw, err := query(fmt.Sprintf("GET downtimes\nFilter: id = %s\nColumns:id author comment duration start_time end_time entry_time fixed type host_name service_description", vars["id"]))
+	if row, ok := stateCache.get(w, r, "downtimes", vars["id"]); ok {
+		writeJSON(w, r, row)
+		return
+	}
+
+	raw, err := query(fmt.Sprintf("GET downtimes\nFilter: id = %s\nColumns:%s", vars["id"], downtimeColumns))
 	if err != nil {
-		log.Fatal(err)
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
 	}
 	defer raw.Close()
 
 	err = json.NewDecoder(raw).Decode(&downtimes)
 	if len(downtimes) > 0 {
-		json.NewEncoder(w).Encode(downtimes[0])
+		writeJSON(w, r, downtimes[0])
 	} else {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("404 - Downtime not found"))
@@ -457,31 +888,64 @@ func getDowntime(w http.ResponseWriter, r *http.Request) {
 }
 
 func getHosts(w http.ResponseWriter, r *http.Request) {
-	var hosts []Host
+	format, err := parseFormat(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if rows, ok := stateCache.list(w, r, "hosts"); ok {
+		writeRows(w, r, "hosts", format, rows)
+		return
+	}
+
+	filters, err := parseFilters("hosts", r.URL.Query()["filter"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	custom, err := parseCustomFilters(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filters += customFilters(custom)
 
-	raw, err := query("GET hosts\nColumns:id name alias acknowledged address check_period check_source checks_enabled comments contacts downtimes event_handler event_handler_enabled execution_time flap_detection_enabled groups hard_state has_been_checked in_check_period in_notification_period is_flapping last_check last_notification last_state_change last_time_down last_time_unreachable last_time_up latency next_check next_notification notification_period notifications_enabled num_services num_services_hard_crit num_services_hard_ok num_services_hard_unknown num_services_hard_warn num_services_pending state state_type services")
+	raw, err := query("GET hosts\n" + filters + "Columns:" + hostColumns)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer raw.Close()
 
-	err = json.NewDecoder(raw).Decode(&hosts)
-	json.NewEncoder(w).Encode(hosts)
+	streamRows(w, r, raw, "hosts", format)
 }
 
 func getHost(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	var hosts []Host
 
-	raw, err := query(fmt.Sprintf("GET hosts\nFilter: name = %s\nColumns:id name alias acknowledged address check_period check_source checks_enabled comments contacts downtimes event_handler event_handler_enabled execution_time flap_detection_enabled groups hard_state has_been_checked in_check_period in_notification_period is_flapping last_check last_notification last_state_change last_time_down last_time_unreachable last_time_up latency next_check next_notification notification_period notifications_enabled num_services num_services_hard_crit num_services_hard_ok num_services_hard_unknown num_services_hard_warn num_services_pending state state_type services", vars["name"]))
+	wait, deadline, err := parseLongPoll(r, "hosts", vars["name"])
 	if err != nil {
-		log.Fatal(err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if wait == "" {
+		if row, ok := stateCache.get(w, r, "hosts", vars["name"]); ok {
+			writeJSON(w, r, row)
+			return
+		}
+	}
+
+	raw, err := queryDeadline(fmt.Sprintf("GET hosts\nFilter: name = %s\n%sColumns:%s", vars["name"], wait, hostColumns), deadline)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
 	}
 	defer raw.Close()
 
 	err = json.NewDecoder(raw).Decode(&hosts)
 	if len(hosts) > 0 {
-		json.NewEncoder(w).Encode(hosts[0])
+		writeJSON(w, r, hosts[0])
 	} else {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("404 - Host not found"))
@@ -489,39 +953,155 @@ func getHost(w http.ResponseWriter, r *http.Request) {
 }
 
 func getServices(w http.ResponseWriter, r *http.Request) {
-	var services []Service
+	format, err := parseFormat(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if rows, ok := stateCache.list(w, r, "services"); ok {
+		writeRows(w, r, "services", format, rows)
+		return
+	}
 
-	raw, err := query("GET services\nColumns:id acknowledged check_period check_source check_type checks_enabled comments contacts description downtimes event_handler event_handler_enabled execution_time flap_detection_enabled groups has_been_checked in_check_period in_notification_period is_flapping last_check last_notification last_state_change last_time_critical last_time_ok last_time_unknown last_time_warning latency next_check next_notification notification_period notifications_enabled state state_type host_name")
+	filters, err := parseFilters("services", r.URL.Query()["filter"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	custom, err := parseCustomFilters(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filters += customFilters(custom)
+
+	raw, err := query("GET services\n" + filters + "Columns:" + serviceColumns)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer raw.Close()
 
-	err = json.NewDecoder(raw).Decode(&services)
-	json.NewEncoder(w).Encode(services)
+	streamRows(w, r, raw, "services", format)
 }
 
 func getService(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	var services []Service
 
-	raw, err := query(fmt.Sprintf("GET services\nFilter: host_name = %s\nFilter: description = %s\nColumns:id acknowledged check_period check_source check_type checks_enabled comments contacts description downtimes event_handler event_handler_enabled execution_time flap_detection_enabled groups has_been_checked in_check_period in_notification_period is_flapping last_check last_notification last_state_change last_time_critical last_time_ok last_time_unknown last_time_warning latency next_check next_notification notification_period notifications_enabled state state_type host_name", vars["host_name"], vars["name"]))
+	key := vars["host_name"] + ";" + vars["name"]
+	wait, deadline, err := parseLongPoll(r, "services", key)
 	if err != nil {
-		log.Fatal(err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if wait == "" {
+		if row, ok := stateCache.get(w, r, "services", key); ok {
+			writeJSON(w, r, row)
+			return
+		}
+	}
+
+	raw, err := queryDeadline(fmt.Sprintf("GET services\nFilter: host_name = %s\nFilter: description = %s\n%sColumns:%s", vars["host_name"], vars["name"], wait, serviceColumns), deadline)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
 	}
 	defer raw.Close()
 
 	err = json.NewDecoder(raw).Decode(&services)
 	if len(services) > 0 {
-		json.NewEncoder(w).Encode(services[0])
+		writeJSON(w, r, services[0])
 	} else {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("404 - Service not found"))
 	}
 }
 
+// logWindow is how far back /log reads unless filtered on time, as Livestatus
+// answers queries on the log table from the core's log files.
+const logWindow = 24 * time.Hour
+
+func getLog(w http.ResponseWriter, r *http.Request) {
+	format, err := parseFormat(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filters, err := parseFilters("log", r.URL.Query()["filter"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !strings.Contains(filters, "Filter: time ") {
+		filters += fmt.Sprintf("Filter: time >= %d\n", time.Now().Add(-logWindow).Unix())
+	}
+
+	raw, err := query("GET log\n" + filters + "Columns:" + logColumns)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	defer raw.Close()
+
+	streamRows(w, r, raw, "log", format)
+}
+
+func getStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := findStatus()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, r, status)
+}
+
 func main() {
+	flag.Parse()
+
+	loc, err := time.LoadLocation(*reprTimezone)
+	if err != nil {
+		log.Fatal(err)
+	}
+	reprLocation = loc
+
+	if *webhookConfig != "" {
+		c, err := loadWebhooks(*webhookConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		webhooks.config = c
+		go runWebhooks(c)
+	}
+	if *cacheRefresh > 0 {
+		go stateCache.run()
+	}
+	if *perfDataPushURL != "" {
+		u, err := parsePushURL(*perfDataPushURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go pushPerfData(u, *perfDataPushInterval)
+	}
+
+	router := newRouter()
+
+	if graphqlSchema, err = newGraphQLSchema(); err != nil {
+		log.Fatal(err)
+	}
+	if openAPISpec, err = buildOpenAPI(router); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Fatal(http.ListenAndServe(*listenAddress, compress(router)))
+}
+
+// newRouter registers every route of the API.
+func newRouter() *mux.Router {
 	router := mux.NewRouter()
+	router.Use(checkPathVars)
 	router.HandleFunc("/comments", getComments)
 	router.HandleFunc("/comments/{id:[0-9]+}", getComment)
 	router.HandleFunc("/contacts", getContacts)
@@ -529,8 +1109,48 @@ func main() {
 	router.HandleFunc("/downtimes", getDowntimes)
 	router.HandleFunc("/downtimes/{id:[0-9]+}", getDowntime)
 	router.HandleFunc("/hosts", getHosts)
-	router.HandleFunc("/hosts/{name}", getHost)
+	router.HandleFunc("/hosts/{name}", getHost).Methods("GET", "HEAD")
+	router.HandleFunc("/hosts/{name}", patchHost).Methods("PATCH")
 	router.HandleFunc("/services", getServices)
-	router.HandleFunc("/hosts/{host_name}/services/{name}", getService)
-	log.Fatal(http.ListenAndServe(*listenAddress, router))
+	router.HandleFunc("/log", getLog)
+	router.HandleFunc("/perfdata", getPerfData)
+	router.HandleFunc("/topology", getTopology)
+	router.HandleFunc("/timing", getTiming)
+	router.HandleFunc("/hosts/{host_name}/services/{name}", getService).Methods("GET", "HEAD")
+	router.HandleFunc("/hosts/{host_name}/services/{name}", patchService).Methods("PATCH")
+	router.HandleFunc("/hosts/{name}/perfdata", getHostPerfData)
+	router.HandleFunc("/hosts/{name}/parents", getHostParents)
+	router.HandleFunc("/hosts/{name}/children", getHostChildren)
+	router.HandleFunc("/hosts/{name}/impact", getHostImpact)
+	router.HandleFunc("/hosts/{name}/root-cause", getHostRootCause)
+	router.HandleFunc("/hosts/{host_name}/services/{name}/root-cause", getServiceRootCause)
+	router.HandleFunc("/hosts/{host_name}/services/{name}/perfdata", getServicePerfData)
+	router.HandleFunc("/hosts/{name}/notification", postHostNotification).Methods("POST")
+	router.HandleFunc("/hosts/{host_name}/services/{name}/notification", postServiceNotification).Methods("POST")
+	router.HandleFunc("/status", getStatus).Methods("GET", "HEAD")
+	router.HandleFunc("/status", patchStatus).Methods("PATCH")
+	router.HandleFunc("/bulk", postBulk).Methods("POST")
+	router.HandleFunc("/events", getEvents)
+	router.HandleFunc("/ws", getWebsocket)
+	router.HandleFunc("/webhooks", getWebhooks)
+	router.HandleFunc("/webhooks/deliveries", getWebhookDeliveries)
+	router.HandleFunc("/audit", getAudit)
+	router.HandleFunc("/metrics", getMetrics)
+	router.HandleFunc("/openapi.json", getOpenAPI)
+	router.HandleFunc("/graphql", serveGraphQL).Methods("GET", "POST")
+	return router
+}
+
+// checkPathVars rejects path variables holding line breaks, as mux decodes
+// them and handlers put the variables into Livestatus headers and commands.
+func checkPathVars(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, v := range mux.Vars(r) {
+			if strings.ContainsAny(v, "\r\n") {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("%s must not contain line breaks", name))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
 }
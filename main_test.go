@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	if graphqlSchema, err = newGraphQLSchema(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if openAPISpec, err = buildOpenAPI(newRouter()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	reprLocation = time.UTC
+	// Handlers log every command they send.
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testTables returns the fixtures the handler tests run against: web01 is
+// down with a critical HTTP service, a comment on each and a downtime, and
+// db01 is an unchecked child of web01.
+func testTables() mockTables {
+	now := time.Now().Unix()
+	return mockTables{
+		"hosts": {
+			{
+				"id": 1, "name": "web01", "state": 1, "hard_state": 1, "state_type": 1, "has_been_checked": true,
+				"checks_enabled": true, "notifications_enabled": true, "groups": []string{"web"},
+				"services": []string{"HTTP"}, "comments": []int{7}, "downtimes": []int{3}, "contacts": []string{"alice"},
+				"childs": []string{"db01"}, "last_check": 1700000000, "last_state_change": 1699990000,
+				"custom_variables": map[string]string{"TEAM": "ops"},
+			},
+			{
+				"id": 2, "name": "db01", "parents": []string{"web01"}, "checks_enabled": true,
+				"custom_variables": map[string]string{"TEAM": "dba"},
+			},
+		},
+		"services": {
+			{
+				"id": 1, "host_name": "web01", "description": "HTTP", "state": 2, "state_type": 1, "has_been_checked": true,
+				"checks_enabled": true, "comments": []int{8}, "contacts": []string{"alice"}, "host_groups": []string{"web"},
+				"perf_data": "time=0.5s;1;2;0", "custom_variables": map[string]string{"TEAM": "ops"},
+			},
+			{"id": 2, "host_name": "db01", "description": "MySQL", "has_been_checked": true},
+		},
+		"comments": {
+			{"id": 7, "author": "alice", "comment": "looking", "host_name": "web01", "entry_type": 1, "type": 1},
+			{"id": 8, "author": "bob", "comment": "ticket filed", "host_name": "web01", "service_description": "HTTP", "entry_type": 1, "type": 2},
+		},
+		"downtimes": {
+			{"id": 3, "author": "alice", "comment": "maintenance", "host_name": "web01", "start_time": 1700000000, "end_time": 1700003600, "fixed": true},
+		},
+		"contacts": {
+			{"id": 1, "name": "alice", "email": "alice@example.com", "host_notifications_enabled": true},
+			{"id": 2, "name": "bob", "email": "bob@example.com"},
+		},
+		"status": {
+			{"program_version": "1.4.1", "program_start": 1700000000, "nagios_pid": 42, "enable_notifications": true, "execute_host_checks": true},
+		},
+		"log": {
+			{"time": now - 60, "lineno": 1, "class": 1, "type": "SERVICE ALERT", "state": 2, "state_type": "HARD",
+				"host_name": "web01", "service_description": "HTTP", "plugin_output": "Connection refused"},
+			{"time": now - 30, "lineno": 2, "class": 2, "type": "", "message": "Caught SIGHUP"},
+		},
+	}
+}
+
+// serve sends a request to the API's router. header holds pairs of header
+// names and values.
+func serve(method, target, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+// jsonPath returns the value at a dot separated path of object keys and list
+// indexes in a decoded JSON body.
+func jsonPath(v interface{}, path string) interface{} {
+	for _, p := range strings.Split(path, ".") {
+		switch o := v.(type) {
+		case map[string]interface{}:
+			v = o[p]
+		case []interface{}:
+			var i int
+			if _, err := fmt.Sscan(p, &i); err != nil || i >= len(o) {
+				return nil
+			}
+			v = o[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+func TestReadHandlers(t *testing.T) {
+	startMock(t, testTables())
+
+	tests := []struct {
+		name   string
+		target string
+		header []string
+		status int
+		// want maps paths in the decoded JSON body to their values.
+		want map[string]interface{}
+		// names are the name, description or id of each returned object,
+		// in order.
+		names []interface{}
+	}{
+		{name: "hosts", target: "/hosts", names: []interface{}{"web01", "db01"},
+			want: map[string]interface{}{"0.state": 1.0, "0.checks_enabled": true, "0.custom_variables.TEAM": "ops", "1.parents.0": "web01", "0.children.0": "db01"}},
+		{name: "hosts filter", target: "/hosts?filter=state+%3D+1", names: []interface{}{"web01"}},
+		{name: "hosts list filter", target: "/hosts?filter=parents+%3E%3D+web01", names: []interface{}{"db01"}},
+		{name: "hosts custom filter", target: "/hosts?custom.TEAM=dba", names: []interface{}{"db01"}},
+		{name: "hosts bad filter", target: "/hosts?filter=bogus", status: http.StatusBadRequest},
+		{name: "host", target: "/hosts/web01", want: map[string]interface{}{"name": "web01", "services.0": "HTTP", "comments.0": 7.0}},
+		{name: "host not found", target: "/hosts/nope", status: http.StatusNotFound},
+		{name: "services", target: "/services", names: []interface{}{"HTTP", "MySQL"},
+			want: map[string]interface{}{"0.host": "web01", "0.state": 2.0, "0.metrics.0.value": 0.5}},
+		{name: "services filter", target: "/services?filter=host_name+%3D+db01", names: []interface{}{"MySQL"}},
+		{name: "service", target: "/hosts/web01/services/HTTP", want: map[string]interface{}{"description": "HTTP", "comments.0": 8.0}},
+		{name: "service not found", target: "/hosts/web01/services/SSH", status: http.StatusNotFound},
+		{name: "comments", target: "/comments", names: []interface{}{7.0, 8.0},
+			want: map[string]interface{}{"1.service_description": "HTTP", "0.author": "alice"}},
+		{name: "comments filter", target: "/comments?filter=author+%3D+bob", names: []interface{}{8.0}},
+		{name: "comment", target: "/comments/8", want: map[string]interface{}{"comment": "ticket filed"}},
+		{name: "comment not found", target: "/comments/9", status: http.StatusNotFound},
+		{name: "downtimes", target: "/downtimes", names: []interface{}{3.0}, want: map[string]interface{}{"0.fixed": true, "0.end_time": 1700003600.0}},
+		{name: "downtime", target: "/downtimes/3", want: map[string]interface{}{"comment": "maintenance"}},
+		{name: "contacts", target: "/contacts", names: []interface{}{"alice", "bob"}, want: map[string]interface{}{"0.email": "alice@example.com"}},
+		{name: "contacts filter", target: "/contacts?filter=name+~+%5Eb", names: []interface{}{"bob"}},
+		{name: "contact", target: "/contacts/bob", want: map[string]interface{}{"email": "bob@example.com"}},
+		{name: "status", target: "/status", want: map[string]interface{}{"program_version": "1.4.1", "enable_notifications": true, "execute_service_checks": false}},
+		{name: "log", target: "/log", want: map[string]interface{}{"0.type": "SERVICE ALERT", "0.plugin_output": "Connection refused", "1.message": "Caught SIGHUP"}},
+		{name: "log filter", target: "/log?filter=class+%3D+2", want: map[string]interface{}{"0.message": "Caught SIGHUP", "1": nil}},
+		{name: "unknown format", target: "/hosts?format=xml", status: http.StatusBadRequest},
+
+		{name: "hosts sort", target: "/hosts?sort=name", names: []interface{}{"db01", "web01"}},
+		{name: "services sort", target: "/services?sort=state,-host", names: []interface{}{"MySQL", "HTTP"}},
+		{name: "comments sort descending", target: "/comments?sort=-id", names: []interface{}{8.0, 7.0}},
+		{name: "hosts fields", target: "/hosts?fields=name,state", names: []interface{}{"web01", "db01"},
+			want: map[string]interface{}{"0.state": 1.0, "0.checks_enabled": nil, "0.custom_variables": nil}},
+		{name: "hal fields", target: "/hosts?fields=name&include=services&sort=name", names: []interface{}{"db01", "web01"},
+			want: map[string]interface{}{"1._embedded.services.0.description": "HTTP", "1._links.self.href": "/hosts/web01", "1.state": nil}},
+		{name: "human fields", target: "/services?fields=description,state&repr=human", want: map[string]interface{}{"0.state": "CRITICAL", "0.host": nil}},
+		{name: "unknown sort field", target: "/hosts?sort=bogus", status: http.StatusBadRequest},
+		{name: "unsortable field", target: "/hosts?sort=parents", status: http.StatusBadRequest},
+		{name: "unknown field", target: "/services?fields=description,bogus", status: http.StatusBadRequest},
+
+		{name: "human host", target: "/hosts/web01?repr=human&tz=UTC",
+			want: map[string]interface{}{"state": "DOWN", "state_type": "HARD", "last_check": "2023-11-14T22:13:20Z", "next_check": nil}},
+		{name: "human profile", target: "/services", header: []string{"Accept", `application/json; profile="human"`},
+			want: map[string]interface{}{"0.state": "CRITICAL", "1.state": "OK"}},
+		{name: "human status", target: "/status?repr=human&tz=UTC", want: map[string]interface{}{"program_start": "2023-11-14T22:13:20Z"}},
+		{name: "unknown repr", target: "/hosts?repr=fancy", status: http.StatusBadRequest},
+
+		{name: "hal host", target: "/hosts/web01", header: []string{"Accept", "application/hal+json"},
+			want: map[string]interface{}{"_links.self.href": "/hosts/web01", "_links.services.0.href": "/hosts/web01/services/HTTP", "_links.comments.0.href": "/comments/7", "_links.contacts.0.href": "/contacts/alice"}},
+		{name: "hal include", target: "/hosts?include=services,comments", names: []interface{}{"web01", "db01"},
+			want: map[string]interface{}{"0._embedded.services.0.description": "HTTP", "0._embedded.services.0._links.host.href": "/hosts/web01", "0._embedded.comments.0.author": "alice", "1._embedded.services": []interface{}{}}},
+		{name: "hal service include", target: "/hosts/web01/services/HTTP?include=host", want: map[string]interface{}{"_embedded.host.name": "web01", "_links.host.href": "/hosts/web01"}},
+		{name: "hal comment", target: "/comments/8?include=service", want: map[string]interface{}{"_links.service.href": "/hosts/web01/services/HTTP", "_embedded.service.state": 2.0}},
+		{name: "hal unknown include", target: "/comments?include=contacts", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve("GET", tt.target, "", tt.header...)
+			status := tt.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if rec.Code != status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, status, rec.Body)
+			}
+			if status != http.StatusOK {
+				return
+			}
+
+			var body interface{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding %q: %v", rec.Body, err)
+			}
+			if tt.names != nil {
+				var names []interface{}
+				for _, o := range body.([]interface{}) {
+					o := o.(map[string]interface{})
+					switch {
+					case o["description"] != nil:
+						names = append(names, o["description"])
+					case o["name"] != nil:
+						names = append(names, o["name"])
+					default:
+						names = append(names, o["id"])
+					}
+				}
+				if !reflect.DeepEqual(names, tt.names) {
+					t.Errorf("names = %v, want %v", names, tt.names)
+				}
+			}
+			for path, want := range tt.want {
+				if got := jsonPath(body, path); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %#v, want %#v", path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCollectionFormats(t *testing.T) {
+	startMock(t, testTables())
+
+	tests := []struct {
+		target      string
+		accept      string
+		contentType string
+		want        string
+	}{
+		{"/contacts?format=csv", "", "text/csv; charset=utf-8",
+			"id,name,alias,email,pager,host_notification_period,host_notifications_enabled,service_notification_period,service_notifications_enabled\n" +
+				"1,alice,,alice@example.com,,,true,,false\n2,bob,,bob@example.com,,,false,,false\n"},
+		{"/contacts", "text/csv", "text/csv; charset=utf-8", ""},
+		{"/contacts?format=csv&fields=email,name&sort=-name", "", "text/csv; charset=utf-8",
+			"email,name\nbob@example.com,bob\nalice@example.com,alice\n"},
+		{"/comments?format=ndjson&fields=author&sort=-id", "", "application/x-ndjson", `{"author":"bob"}` + "\n" + `{"author":"alice"}` + "\n"},
+		{"/hosts?fields=name&include=services", "", "application/hal+json", ""},
+		{"/comments?format=ndjson&filter=id+%3D+7", "", "application/x-ndjson",
+			`{"id":7,"author":"alice","comment":"looking","entry_time":0,"entry_type":1,"expire_time":0,"expires":false,"type":1,"host_name":"web01","service_description":""}` + "\n"},
+		{"/comments", "application/x-ndjson", "application/x-ndjson", ""},
+		{"/hosts?filter=name+%3D+nope", "", "", "null\n"},
+		{"/hosts", "application/hal+json", "application/hal+json", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target+" "+tt.accept, func(t *testing.T) {
+			rec := serve("GET", tt.target, "", "Accept", tt.accept)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			if tt.contentType != "" {
+				if ct := rec.Header().Get("Content-Type"); ct != tt.contentType {
+					t.Errorf("Content-Type = %q, want %q", ct, tt.contentType)
+				}
+			}
+			if tt.want != "" && rec.Body.String() != tt.want {
+				t.Errorf("body = %q, want %q", rec.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandHandlers(t *testing.T) {
+	future := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		header []string
+		status int
+		want   []string
+	}{
+		{name: "disable host checks", method: "PATCH", target: "/hosts/web01",
+			body: `{"checks_enabled": false, "notifications_enabled": true, "event_handler_enabled": true}`,
+			want: []string{"DISABLE_HOST_CHECK;web01", "ENABLE_HOST_EVENT_HANDLER;web01"}},
+		{name: "delay host notification", method: "PATCH", target: "/hosts/web01",
+			body: fmt.Sprintf(`{"next_notification": %d}`, future),
+			want: []string{fmt.Sprintf("DELAY_HOST_NOTIFICATION;web01;%d", future)}},
+		{name: "unchanged host", method: "PATCH", target: "/hosts/web01", body: `{"checks_enabled": true}`},
+		{name: "unknown host field", method: "PATCH", target: "/hosts/web01", body: `{"state": 0}`, status: http.StatusBadRequest},
+		{name: "missing host", method: "PATCH", target: "/hosts/nope", body: `{"checks_enabled": false}`, status: http.StatusNotFound},
+		{name: "service", method: "PATCH", target: "/hosts/web01/services/HTTP",
+			body: `{"checks_enabled": false, "flap_detection_enabled": true}`,
+			want: []string{"DISABLE_SVC_CHECK;web01;HTTP", "ENABLE_SVC_FLAP_DETECTION;web01;HTTP"}},
+		{name: "status", method: "PATCH", target: "/status",
+			body: `{"enable_notifications": false, "execute_service_checks": true}`,
+			want: []string{"DISABLE_NOTIFICATIONS", "START_EXECUTING_SVC_CHECKS"}},
+		{name: "host notification", method: "POST", target: "/hosts/web01/notification",
+			body: `{"author": "alice", "comment": "Call me", "broadcast": true}`, status: http.StatusAccepted,
+			want: []string{"SEND_CUSTOM_HOST_NOTIFICATION;web01;1;alice;Call me"}},
+		{name: "service notification", method: "POST", target: "/hosts/web01/services/HTTP/notification",
+			body: `{"author": "alice", "comment": "Call me", "forced": true}`, status: http.StatusAccepted,
+			want: []string{"SEND_CUSTOM_SVC_NOTIFICATION;web01;HTTP;2;alice;Call me"}},
+		{name: "notification without comment", method: "POST", target: "/hosts/web01/notification",
+			body: `{}`, status: http.StatusBadRequest},
+		{name: "notification author from header", method: "POST", target: "/hosts/web01/notification",
+			body: `{"comment": "Call me; now"}`, header: []string{"X-Remote-User", "bob"}, status: http.StatusAccepted,
+			want: []string{"SEND_CUSTOM_HOST_NOTIFICATION;web01;0;bob;Call me; now"}},
+		{name: "notification author with semicolon", method: "POST", target: "/hosts/web01/notification",
+			body: `{"author": "a;b", "comment": "Call me"}`, status: http.StatusBadRequest},
+		{name: "notification header author with semicolon", method: "POST", target: "/hosts/web01/services/HTTP/notification",
+			body: `{"comment": "Call me"}`, header: []string{"X-Remote-User", "a;b"}, status: http.StatusBadRequest},
+		{name: "notification comment with newline", method: "POST", target: "/hosts/web01/notification",
+			body: `{"comment": "Call me\nCOMMAND"}`, status: http.StatusBadRequest},
+		{name: "bulk acknowledge", method: "POST", target: "/bulk",
+			body: `{"action": "acknowledge", "table": "services", "filter": ["state = 2"], "author": "alice", "comment": "on it", "sticky": true}`,
+			want: []string{"ACKNOWLEDGE_SVC_PROBLEM;web01;HTTP;2;0;0;alice;on it"}},
+		{name: "bulk comment with newline", method: "POST", target: "/bulk",
+			body: `{"action": "comment", "table": "hosts", "filter": ["state != 0"], "comment": "one\ntwo"}`, status: http.StatusBadRequest},
+		{name: "bulk comment with semicolon", method: "POST", target: "/bulk",
+			body: `{"action": "comment", "table": "hosts", "filter": ["state != 0"], "comment": "ticket 123; see runbook"}`,
+			want: []string{"ADD_HOST_COMMENT;web01;0;livestatus-api;ticket 123; see runbook"}},
+		{name: "bulk dry run author with semicolon", method: "POST", target: "/bulk",
+			body:   `{"action": "acknowledge", "table": "hosts", "filter": ["state != 0"], "author": "a;b", "comment": "x", "dry_run": true}`,
+			status: http.StatusBadRequest},
+		{name: "bulk dry run", method: "POST", target: "/bulk",
+			body: `{"action": "recheck", "table": "hosts", "filter": ["state != 0"], "dry_run": true}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := startMock(t, testTables())
+			rec := serve(tt.method, tt.target, tt.body, tt.header...)
+			status := tt.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if rec.Code != status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, status, rec.Body)
+			}
+			if got := m.commands(len(tt.want)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("commands = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPatchReturnsObject(t *testing.T) {
+	startMock(t, testTables())
+
+	rec := serve("PATCH", "/hosts/web01/services/HTTP?repr=human", `{"checks_enabled": false}`, "Accept", "application/hal+json")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("ETag") == "" {
+		t.Error("no ETag")
+	}
+	var s map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	// The mock does not act on commands, so the service is as it was.
+	if s["description"] != "HTTP" || s["checks_enabled"] != true || s["state"] != "CRITICAL" {
+		t.Errorf("got %v", s)
+	}
+	if got := jsonPath(s, "_links.self.href"); got != "/hosts/web01/services/HTTP" {
+		t.Errorf("self link = %v", got)
+	}
+}
+
+func TestPatchStatus(t *testing.T) {
+	startMock(t, testTables())
+
+	get := serve("GET", "/status?repr=human&tz=UTC", "")
+	patch := serve("PATCH", "/status?repr=human&tz=UTC", `{"enable_notifications": true}`)
+	if patch.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", patch.Code, patch.Body)
+	}
+	if patch.Body.String() != get.Body.String() || patch.Header().Get("ETag") != get.Header().Get("ETag") {
+		t.Errorf("PATCH returned %q with ETag %q, GET %q with %q",
+			patch.Body, patch.Header().Get("ETag"), get.Body, get.Header().Get("ETag"))
+	}
+}
+
+func TestHead(t *testing.T) {
+	startMock(t, testTables())
+
+	for _, target := range []string{"/hosts/web01", "/hosts/web01/services/HTTP", "/status"} {
+		get := serve("GET", target, "")
+		head := serve("HEAD", target, "")
+		if head.Code != http.StatusOK || head.Body.Len() != 0 {
+			t.Errorf("HEAD %s: status = %d, body %q", target, head.Code, head.Body)
+		}
+		if etag := head.Header().Get("ETag"); etag == "" || etag != get.Header().Get("ETag") {
+			t.Errorf("HEAD %s: ETag = %q, GET has %q", target, etag, get.Header().Get("ETag"))
+		}
+	}
+}
+
+func TestBulkResults(t *testing.T) {
+	startMock(t, testTables())
+
+	rec := serve("POST", "/bulk", `{"action": "disable", "feature": "notifications", "table": "hosts", "filter": ["groups >= web"], "dry_run": true}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp BulkResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" || rec.Header().Get("ETag") == "" {
+		t.Errorf("Content-Type = %q, ETag %q", ct, rec.Header().Get("ETag"))
+	}
+	if !resp.DryRun || len(resp.Results) != 1 {
+		t.Fatalf("got %+v", resp)
+	}
+	r := resp.Results[0]
+	if r.HostName != "web01" || r.Status != "pending" || !reflect.DeepEqual(r.Commands, []string{"DISABLE_HOST_NOTIFICATIONS;web01"}) {
+		t.Errorf("got %+v", r)
+	}
+}
+
+func TestLivestatusUnreachable(t *testing.T) {
+	defer func(path string) { *socket = path }(*socket)
+	*socket = t.TempDir() + "/missing"
+
+	for _, target := range []string{
+		"/log",
+		"/hosts/web01",
+		"/hosts/web01?wait_condition=state+%3D+0&wait_timeout=1s",
+		"/hosts/web01/services/HTTP?wait_trigger=state",
+		"/comments/7",
+		"/downtimes/3",
+		"/contacts/alice",
+	} {
+		if rec := serve("GET", target, ""); rec.Code != http.StatusBadGateway {
+			t.Errorf("%s: status = %d: %s", target, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestPathVarsLineBreaks(t *testing.T) {
+	m := startMock(t, testTables())
+
+	for _, target := range []string{
+		"/hosts/x%0AColumns:%20name",
+		"/hosts/x%0D%0AWaitTrigger:%20all?wait_timeout=1s",
+		"/hosts/web01/services/x%0AFilter:%20state%20=%200",
+		"/contacts/x%0AColumns:%20email",
+		"/hosts/x%0A/perfdata",
+	} {
+		if rec := serve("GET", target, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d: %s", target, rec.Code, rec.Body)
+		}
+	}
+	if rec := serve("POST", "/hosts/x%0AEXTRA/notification", `{"comment": "hi"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("notification: status = %d: %s", rec.Code, rec.Body)
+	}
+	if n := m.queryCount("hosts") + m.queryCount("services") + m.queryCount("contacts"); n != 0 {
+		t.Errorf("%d queries sent", n)
+	}
+	if cmds := m.commands(0); len(cmds) != 0 {
+		t.Errorf("commands sent: %q", cmds)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hostMetricColumns and serviceMetricColumns list the columns
+// objectMetrics.UnmarshalJSON expects. Services have a description after the
+// host name.
+const (
+	hostMetricColumns    = "name groups state acknowledged scheduled_downtime_depth is_flapping latency execution_time"
+	serviceMetricColumns = "host_name description groups state acknowledged scheduled_downtime_depth is_flapping latency execution_time"
+)
+
+// statusCounters are the status table's cumulative counters, exposed as
+// livestatus_<name>_total.
+const statusCounters = "requests connections host_checks service_checks external_commands log_messages neb_callbacks forks"
+
+// objectMetrics is what /metrics reports about a host or service.
+type objectMetrics struct {
+	HostName      string
+	Description   string
+	Groups        []string
+	State         int
+	Acknowledged  bool
+	InDowntime    bool
+	Flapping      bool
+	Latency       float64
+	ExecutionTime float64
+}
+
+func (m *objectMetrics) UnmarshalJSON(b []byte) (err error) {
+	var tmp []interface{}
+
+	if err := json.Unmarshal(b, &tmp); err != nil {
+		return err
+	}
+
+	m.HostName = tmp[0].(string)
+	if len(tmp) == len(strings.Fields(serviceMetricColumns)) {
+		m.Description = tmp[1].(string)
+		tmp = tmp[1:]
+	}
+	for _, g := range tmp[1].([]interface{}) {
+		m.Groups = append(m.Groups, g.(string))
+	}
+	m.State = int(tmp[2].(float64))
+	m.Acknowledged = tmp[3].(float64) == 1
+	m.InDowntime = tmp[4].(float64) > 0
+	m.Flapping = tmp[5].(float64) == 1
+	m.Latency = tmp[6].(float64)
+	m.ExecutionTime = tmp[7].(float64)
+
+	return nil
+}
+
+func queryObjectMetrics(table, columns string) ([]objectMetrics, error) {
+	var objs []objectMetrics
+
+	raw, err := query("GET " + table + "\nColumns: " + columns)
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+
+	if err := json.NewDecoder(raw).Decode(&objs); err != nil {
+		return nil, err
+	}
+	return objs, nil
+}
+
+func queryStatusCounters() ([]float64, error) {
+	var rows [][]float64
+
+	raw, err := query("GET status\nColumns: " + statusCounters)
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+
+	if err := json.NewDecoder(raw).Decode(&rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("livestatus returned no status row")
+	}
+	return rows[0], nil
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promWriter writes the Prometheus text exposition format.
+type promWriter struct {
+	bytes.Buffer
+}
+
+func (p *promWriter) family(name, typ, help string) {
+	fmt.Fprintf(p, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one sample. labels are name and value pairs.
+func (p *promWriter) sample(name string, value float64, labels ...string) {
+	p.WriteString(name)
+	if len(labels) > 0 {
+		p.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				p.WriteByte(',')
+			}
+			fmt.Fprintf(p, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		p.WriteByte('}')
+	}
+	p.WriteByte(' ')
+	p.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	p.WriteByte('\n')
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var (
+	hostStateNames    = []string{"up", "down", "unreachable"}
+	serviceStateNames = []string{"ok", "warning", "critical", "unknown"}
+)
+
+// objectSeries writes the per-object families for kind, prefixed with
+// livestatus_host_ or livestatus_service_.
+func (p *promWriter) objectSeries(kind string, objs []objectMetrics) {
+	labels := func(m *objectMetrics) []string {
+		l := []string{"host", m.HostName}
+		if kind == "service" {
+			l = append(l, "service", m.Description)
+		}
+		if *metricsGroupLabels {
+			groups := append([]string(nil), m.Groups...)
+			sort.Strings(groups)
+			l = append(l, "groups", strings.Join(groups, ","))
+		}
+		return l
+	}
+
+	families := []struct {
+		name, typ, help string
+		value           func(m *objectMetrics) float64
+	}{
+		{"state", "gauge", "Current state of the " + kind + ".", func(m *objectMetrics) float64 { return float64(m.State) }},
+		{"acknowledged", "gauge", "Whether the " + kind + "'s problem is acknowledged.", func(m *objectMetrics) float64 { return boolValue(m.Acknowledged) }},
+		{"in_downtime", "gauge", "Whether the " + kind + " is in scheduled downtime.", func(m *objectMetrics) float64 { return boolValue(m.InDowntime) }},
+		{"flapping", "gauge", "Whether the " + kind + " is flapping.", func(m *objectMetrics) float64 { return boolValue(m.Flapping) }},
+		{"check_latency_seconds", "gauge", "Latency of the " + kind + "'s last check.", func(m *objectMetrics) float64 { return m.Latency }},
+		{"check_execution_time_seconds", "gauge", "Execution time of the " + kind + "'s last check.", func(m *objectMetrics) float64 { return m.ExecutionTime }},
+	}
+	for _, f := range families {
+		name := "livestatus_" + kind + "_" + f.name
+		p.family(name, f.typ, f.help)
+		for i := range objs {
+			p.sample(name, f.value(&objs[i]), labels(&objs[i])...)
+		}
+	}
+}
+
+// aggregates writes the number of hosts or services by state, and how many
+// are acknowledged, in downtime or flapping.
+func (p *promWriter) aggregates(kind string, states []string, objs []objectMetrics) {
+	byState := make([]int, len(states))
+	var acknowledged, inDowntime, flapping int
+	for _, m := range objs {
+		if m.State >= 0 && m.State < len(states) {
+			byState[m.State]++
+		}
+		if m.Acknowledged {
+			acknowledged++
+		}
+		if m.InDowntime {
+			inDowntime++
+		}
+		if m.Flapping {
+			flapping++
+		}
+	}
+
+	name := "livestatus_" + kind + "s"
+	p.family(name, "gauge", "Number of "+kind+"s by state.")
+	for i, s := range states {
+		p.sample(name, float64(byState[i]), "state", s)
+	}
+	p.family(name+"_acknowledged", "gauge", "Number of "+kind+"s with an acknowledged problem.")
+	p.sample(name+"_acknowledged", float64(acknowledged))
+	p.family(name+"_in_downtime", "gauge", "Number of "+kind+"s in scheduled downtime.")
+	p.sample(name+"_in_downtime", float64(inDowntime))
+	p.family(name+"_flapping", "gauge", "Number of flapping "+kind+"s.")
+	p.sample(name+"_flapping", float64(flapping))
+}
+
+// getMetrics serves host, service and core metrics for Prometheus. If
+// Livestatus cannot be queried, only livestatus_up is reported, as 0.
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	var p promWriter
+
+	hosts, err := queryObjectMetrics("hosts", hostMetricColumns)
+	var services []objectMetrics
+	if err == nil {
+		services, err = queryObjectMetrics("services", serviceMetricColumns)
+	}
+	var status *Status
+	if err == nil {
+		status, err = findStatus()
+	}
+	var counters []float64
+	if err == nil {
+		counters, err = queryStatusCounters()
+	}
+
+	if err != nil {
+		log.Printf("metrics: %v", err)
+	}
+	p.family("livestatus_up", "gauge", "Whether Livestatus could be queried.")
+	p.sample("livestatus_up", boolValue(err == nil))
+	if err == nil {
+		p.aggregates("host", hostStateNames, hosts)
+		p.aggregates("service", serviceStateNames, services)
+		if *metricsHostSeries {
+			p.objectSeries("host", hosts)
+		}
+		if *metricsServiceSeries {
+			p.objectSeries("service", services)
+		}
+
+		p.family("livestatus_info", "gauge", "Versions of the core and Livestatus.")
+		p.sample("livestatus_info", 1, "program_version", status.ProgramVersion, "livestatus_version", status.LivestatusVersion)
+		p.family("livestatus_program_start_time_seconds", "gauge", "Unix time the core was started.")
+		p.sample("livestatus_program_start_time_seconds", float64(status.ProgramStart))
+		for i, c := range strings.Fields(statusCounters) {
+			name := "livestatus_" + c + "_total"
+			p.family(name, "counter", "Value of the status table's "+c+" counter.")
+			p.sample(name, counters[i])
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(p.Bytes())
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockStringColumns and mockListColumns classify the columns the API reads,
+// so that mockLivestatus can give columns missing from a fixture row a zero
+// value of the type the API expects. Other columns are numbers.
+var (
+	mockStringColumns = setOf("name alias address check_period check_source event_handler notification_period " +
+		"perf_data plugin_output long_plugin_output notes notes_url action_url icon_image display_name check_command " +
+		"description host_name service_description author comment email pager host_notification_period " +
+		"service_notification_period program_version livestatus_version contact_name options message")
+	mockListColumns = setOf("comments contacts downtimes groups host_groups services parents childs " +
+		"custom_variable_names custom_variable_values depends_exec depends_notify")
+	// mockTableStringColumns are string columns of one table that are
+	// numbers in others.
+	mockTableStringColumns = map[string]map[string]bool{
+		"log": setOf("type state_type"),
+	}
+)
+
+func setOf(names string) map[string]bool {
+	set := make(map[string]bool)
+	for _, n := range strings.Fields(names) {
+		set[n] = true
+	}
+	return set
+}
+
+// mockLivestatus is an in-process Livestatus serving fixed tables on a UNIX
+// socket, for testing handlers without a monitoring core. It answers GET
+// queries with Columns, Filter, And, Or, Negate, Stats, StatsAnd, StatsOr,
+// StatsNegate, Limit, OutputFormat and ResponseHeader headers, returns at
+// once from queries with Wait headers, and records the queries and external
+// commands it receives rather than acting on them.
+type mockLivestatus struct {
+	path     string
+	listener net.Listener
+
+	mu       sync.Mutex
+	tables   map[string][]map[string]interface{}
+	queries  []string
+	received []string
+}
+
+// mockTables are fixture rows of column values by table name. Values may be
+// any Go values that encode to JSON; numbers are sent as floats and
+// booleans as 0 or 1, as Livestatus does.
+type mockTables map[string][]map[string]interface{}
+
+// startMock serves tables on a socket in a temporary directory and points
+// the API at it until the test ends.
+func startMock(tb testing.TB, tables mockTables) *mockLivestatus {
+	tb.Helper()
+
+	// Socket paths are limited to about 100 bytes, which test temporary
+	// directories can exceed.
+	dir, err := os.MkdirTemp("", "livestatus")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	m, err := newMockLivestatus(filepath.Join(dir, "live"), tables)
+	if err != nil {
+		os.RemoveAll(dir)
+		tb.Fatal(err)
+	}
+
+	saved := *socket
+	*socket = m.path
+	tb.Cleanup(func() {
+		*socket = saved
+		m.listener.Close()
+		os.RemoveAll(dir)
+	})
+	return m
+}
+
+// newMockLivestatus serves tables on a UNIX socket at path.
+func newMockLivestatus(path string, tables mockTables) (*mockLivestatus, error) {
+	normalized, err := normalizeMockTables(tables)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	m := &mockLivestatus{path: path, listener: l, tables: normalized}
+	go m.serve()
+	return m, nil
+}
+
+// normalizeMockTables converts fixture values to what Livestatus would send
+// by encoding them as JSON and decoding them again.
+func normalizeMockTables(tables mockTables) (map[string][]map[string]interface{}, error) {
+	b, err := json.Marshal(tables)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string][]map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&out); err != nil {
+		return nil, err
+	}
+	for _, rows := range out {
+		for _, row := range rows {
+			for col, v := range row {
+				row[col] = mockValue(v)
+			}
+		}
+	}
+	return out, nil
+}
+
+// mockValue converts a decoded fixture value: numbers to float64 and
+// booleans to 0 or 1.
+func mockValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case bool:
+		if v {
+			return 1.0
+		}
+		return 0.0
+	case []interface{}:
+		for i := range v {
+			v[i] = mockValue(v[i])
+		}
+	}
+	return v
+}
+
+// commands returns the external commands received, without their COMMAND
+// prefix and timestamp. Clients do not wait for commands to be read, so it
+// first waits a little for there to be at least n.
+func (m *mockLivestatus) commands(n int) []string {
+	deadline := time.Now().Add(time.Second)
+	if n == 0 {
+		deadline = time.Now().Add(20 * time.Millisecond)
+	}
+	for {
+		m.mu.Lock()
+		received := append([]string(nil), m.received...)
+		m.mu.Unlock()
+		if (n > 0 && len(received) >= n) || time.Now().After(deadline) {
+			return received
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// queryCount returns how many queries of table were received so far.
+func (m *mockLivestatus) queryCount(table string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, q := range m.queries {
+		if q == table {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *mockLivestatus) serve() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("mock livestatus: %v", err)
+			}
+			return
+		}
+		go m.handle(conn)
+	}
+}
+
+// handle reads requests, each ended by an empty line, until a query or the
+// end of the connection. Clients may send several commands on one
+// connection, but a query is answered by closing it.
+func (m *mockLivestatus) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		req, err := readMockRequest(r)
+		if len(req) == 0 {
+			if err != nil && err != io.EOF {
+				log.Printf("mock livestatus: %v", err)
+			}
+			return
+		}
+
+		switch first := req[0]; {
+		case strings.HasPrefix(first, "COMMAND "):
+			m.command(first)
+		case strings.HasPrefix(first, "GET "):
+			m.answer(conn, strings.TrimPrefix(first, "GET "), req[1:])
+			return
+		default:
+			io.WriteString(conn, "Invalid request method\n")
+			return
+		}
+	}
+}
+
+// readMockRequest returns the lines of the next request from r.
+func readMockRequest(r *bufio.Reader) ([]string, error) {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" && (len(lines) > 0 || err != nil) {
+			return lines, err
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+}
+
+func (m *mockLivestatus) command(line string) {
+	// Commands are "COMMAND [timestamp] NAME;arguments".
+	cmd := strings.TrimPrefix(line, "COMMAND ")
+	if _, rest, ok := strings.Cut(cmd, "] "); ok && strings.HasPrefix(cmd, "[") {
+		cmd = rest
+	}
+
+	m.mu.Lock()
+	m.received = append(m.received, cmd)
+	m.mu.Unlock()
+}
+
+// mockQuery is a parsed GET request.
+type mockQuery struct {
+	table   string
+	columns []string
+	filters []mockPredicate
+	stats   []mockStat
+	limit   int
+	fixed16 bool
+}
+
+// mockPredicate reports whether a row matches a filter.
+type mockPredicate func(row map[string]interface{}) bool
+
+// mockStat is a Stats header: either a filter whose matching rows are
+// counted, or an aggregation of a column.
+type mockStat struct {
+	match  mockPredicate
+	op     string
+	column string
+}
+
+func (m *mockLivestatus) answer(w io.Writer, table string, headers []string) {
+	q, err := parseMockQuery(table, headers)
+	if err != nil {
+		writeMockResponse(w, q, 400, []byte(err.Error()+"\n"))
+		return
+	}
+
+	m.mu.Lock()
+	m.queries = append(m.queries, q.table)
+	rows, ok := m.tables[q.table]
+	m.mu.Unlock()
+	if !ok {
+		writeMockResponse(w, q, 404, []byte(fmt.Sprintf("Invalid GET request, no such table '%s'\n", q.table)))
+		return
+	}
+
+	var matched []map[string]interface{}
+	for _, row := range rows {
+		if matchMockRow(q.filters, row) {
+			matched = append(matched, row)
+		}
+	}
+
+	out := [][]interface{}{}
+	columns := q.columns
+	if len(columns) == 0 && len(q.stats) == 0 {
+		// Without Columns Livestatus sends every column, named in a first
+		// row.
+		columns = mockColumns(rows)
+		header := make([]interface{}, len(columns))
+		for i, c := range columns {
+			header[i] = c
+		}
+		out = append(out, header)
+	}
+	if len(q.stats) > 0 {
+		out = append(out, mockStatsRows(q, matched)...)
+	} else {
+		for i, row := range matched {
+			if q.limit > 0 && i == q.limit {
+				break
+			}
+			values := make([]interface{}, len(columns))
+			for i, c := range columns {
+				values[i] = mockColumn(q.table, row, c)
+			}
+			out = append(out, values)
+		}
+	}
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		writeMockResponse(w, q, 452, []byte(err.Error()+"\n"))
+		return
+	}
+	writeMockResponse(w, q, 200, append(b, '\n'))
+}
+
+func writeMockResponse(w io.Writer, q *mockQuery, code int, body []byte) {
+	if q != nil && q.fixed16 {
+		fmt.Fprintf(w, "%3d %11d\n", code, len(body))
+	}
+	w.Write(body)
+}
+
+func parseMockQuery(table string, headers []string) (*mockQuery, error) {
+	q := &mockQuery{table: strings.TrimSpace(table)}
+	var firstErr error
+
+	for _, h := range headers {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Invalid header line %q", h)
+			}
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch name {
+		case "Columns":
+			q.columns = strings.Fields(value)
+		case "Filter":
+			var p mockPredicate
+			if p, err = parseMockFilter(q.table, value); err == nil {
+				q.filters = append(q.filters, p)
+			}
+		case "And", "Or", "Negate":
+			q.filters, err = combineMockFilters(q.filters, name, value)
+		case "Stats":
+			var s mockStat
+			if s, err = parseMockStat(q.table, value); err == nil {
+				q.stats = append(q.stats, s)
+			}
+		case "StatsAnd", "StatsOr", "StatsNegate":
+			q.stats, err = combineMockStats(q.stats, strings.TrimPrefix(name, "Stats"), value)
+		case "Limit":
+			q.limit, err = strconv.Atoi(value)
+		case "OutputFormat":
+			if value != "json" {
+				err = fmt.Errorf("unsupported output format %q", value)
+			}
+		case "ResponseHeader":
+			q.fixed16 = value == "fixed16"
+		case "WaitObject", "WaitCondition", "WaitConditionAnd", "WaitConditionOr", "WaitConditionNegate",
+			"WaitTrigger", "WaitTimeout", "KeepAlive", "ColumnHeaders", "Localtime", "AuthUser":
+			// Accepted and ignored: data never changes by itself.
+		default:
+			err = fmt.Errorf("Undefined request header %q", name)
+		}
+		// Keep going so a later ResponseHeader applies to the error.
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return q, firstErr
+}
+
+// combineMockFilters applies an And, Or or Negate header to the filter
+// stack.
+func combineMockFilters(stack []mockPredicate, op, value string) ([]mockPredicate, error) {
+	n := 1
+	if op != "Negate" {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid %s: %q", op, value)
+		}
+	}
+	if n > len(stack) {
+		return nil, fmt.Errorf("%s: %d needs more filters than the %d given", op, n, len(stack))
+	}
+
+	operands := append([]mockPredicate(nil), stack[len(stack)-n:]...)
+	stack = stack[:len(stack)-n]
+	var p mockPredicate
+	switch op {
+	case "And":
+		p = func(row map[string]interface{}) bool { return matchMockRow(operands, row) }
+	case "Or":
+		p = func(row map[string]interface{}) bool {
+			for _, o := range operands {
+				if o(row) {
+					return true
+				}
+			}
+			return false
+		}
+	case "Negate":
+		p = func(row map[string]interface{}) bool { return !operands[0](row) }
+	}
+	return append(stack, p), nil
+}
+
+// combineMockStats is combineMockFilters for counting Stats headers.
+func combineMockStats(stats []mockStat, op, value string) ([]mockStat, error) {
+	var filters []mockPredicate
+	for _, s := range stats {
+		if s.match == nil {
+			return nil, fmt.Errorf("Stats%s: cannot combine aggregations", op)
+		}
+		filters = append(filters, s.match)
+	}
+	filters, err := combineMockFilters(filters, op, value)
+	if err != nil {
+		return nil, err
+	}
+	stats = stats[:0]
+	for _, f := range filters {
+		stats = append(stats, mockStat{match: f})
+	}
+	return stats, nil
+}
+
+func matchMockRow(filters []mockPredicate, row map[string]interface{}) bool {
+	for _, f := range filters {
+		if !f(row) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseMockStat parses a Stats header, a filter or one of sum, min, max and
+// avg and a column.
+func parseMockStat(table, value string) (mockStat, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 2 {
+		switch fields[0] {
+		case "sum", "min", "max", "avg":
+			return mockStat{op: fields[0], column: fields[1]}, nil
+		}
+	}
+	p, err := parseMockFilter(table, value)
+	return mockStat{match: p}, err
+}
+
+// mockStatsRows computes the stats of rows, grouped by the query's columns.
+func mockStatsRows(q *mockQuery, rows []map[string]interface{}) [][]interface{} {
+	groups := make(map[string][]map[string]interface{})
+	var keys []string
+	for _, row := range rows {
+		values := make([]interface{}, len(q.columns))
+		for i, c := range q.columns {
+			values[i] = mockColumn(q.table, row, c)
+		}
+		b, _ := json.Marshal(values)
+		if _, ok := groups[string(b)]; !ok {
+			keys = append(keys, string(b))
+		}
+		groups[string(b)] = append(groups[string(b)], row)
+	}
+	if len(q.columns) == 0 && len(keys) == 0 {
+		// Ungrouped stats have a row even if nothing matched.
+		keys = append(keys, "[]")
+	}
+	sort.Strings(keys)
+
+	var out [][]interface{}
+	for _, key := range keys {
+		var values []interface{}
+		json.Unmarshal([]byte(key), &values)
+		for _, s := range q.stats {
+			values = append(values, mockAggregate(s, groups[key]))
+		}
+		out = append(out, values)
+	}
+	return out
+}
+
+func mockAggregate(s mockStat, rows []map[string]interface{}) float64 {
+	if s.match != nil {
+		n := 0
+		for _, row := range rows {
+			if s.match(row) {
+				n++
+			}
+		}
+		return float64(n)
+	}
+
+	var sum float64
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, row := range rows {
+		v, _ := row[s.column].(float64)
+		sum += v
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	switch {
+	case len(rows) == 0:
+		return 0
+	case s.op == "min":
+		return min
+	case s.op == "max":
+		return max
+	case s.op == "avg":
+		return sum / float64(len(rows))
+	}
+	return sum
+}
+
+// parseMockFilter parses a "column operator value" filter on table. Lists
+// match with >= if they contain the value and < if they do not, and = and !=
+// an empty value if they are or are not empty.
+func parseMockFilter(table, value string) (mockPredicate, error) {
+	fields := strings.SplitN(value, " ", 3)
+	if len(fields) < 2 || !filterOperators[fields[1]] {
+		return nil, fmt.Errorf("invalid filter %q", value)
+	}
+	column, op := fields[0], fields[1]
+	operand := ""
+	if len(fields) == 3 {
+		operand = fields[2]
+	}
+
+	negate := strings.HasPrefix(op, "!")
+	base := strings.TrimPrefix(op, "!")
+	var re *regexp.Regexp
+	if base == "~" || base == "~~" {
+		expr := operand
+		if base == "~~" {
+			expr = "(?i)" + expr
+		}
+		var err error
+		if re, err = regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %v", operand, err)
+		}
+	}
+
+	return func(row map[string]interface{}) bool {
+		switch v := mockColumn(table, row, column).(type) {
+		case map[string]interface{}:
+			// Dictionary columns are filtered as "column op name value".
+			name, value, _ := strings.Cut(operand, " ")
+			return compareMock(op, fmt.Sprint(v[name]), value)
+		case []interface{}:
+			switch op {
+			case ">=", "<":
+				found := false
+				for _, e := range v {
+					found = found || fmt.Sprint(e) == operand
+				}
+				return found == (op == ">=")
+			case "=":
+				return operand == "" && len(v) == 0
+			case "!=":
+				return operand == "" && len(v) > 0
+			}
+			return false
+		case float64:
+			f, err := strconv.ParseFloat(operand, 64)
+			if err != nil {
+				return false
+			}
+			return compareMock(op, v, f)
+		default:
+			s := fmt.Sprint(v)
+			switch base {
+			case "~", "~~":
+				return re.MatchString(s) != negate
+			case "=~":
+				return strings.EqualFold(s, operand) != negate
+			}
+			return compareMock(op, s, operand)
+		}
+	}, nil
+}
+
+func compareMock[T float64 | string](op string, a, b T) bool {
+	switch op {
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case ">":
+		return a > b
+	case "<=":
+		return a <= b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+// mockColumns returns the columns of rows, sorted.
+func mockColumns(rows []map[string]interface{}) []string {
+	set := make(map[string]bool)
+	for _, row := range rows {
+		for c := range row {
+			set[c] = true
+		}
+	}
+	return sortedKeys(set)
+}
+
+// mockColumn returns the value of column in row, or a zero value if the
+// fixture leaves it out. Custom variables can be given as a custom_variables
+// object, from which the name and value lists are derived.
+func mockColumn(table string, row map[string]interface{}, column string) interface{} {
+	if v, ok := row[column]; ok {
+		return v
+	}
+	custom, _ := row["custom_variables"].(map[string]interface{})
+	switch {
+	case column == "custom_variables":
+		return map[string]interface{}{}
+	case column == "custom_variable_names", column == "custom_variable_values":
+		values := []interface{}{}
+		for _, name := range sortedKeys(custom) {
+			if column == "custom_variable_names" {
+				values = append(values, name)
+			} else {
+				values = append(values, custom[name])
+			}
+		}
+		return values
+	case mockTableStringColumns[table][column]:
+		return ""
+	case mockListColumns[column]:
+		return []interface{}{}
+	case mockStringColumns[column]:
+		return ""
+	}
+	return 0.0
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiOperation documents one method of one route in /openapi.json.
+type apiOperation struct {
+	summary string
+	// params names the query parameters it takes, see apiParameters.
+	params []string
+	// body is the type of its JSON request body, if any.
+	body reflect.Type
+	// response is the type of its JSON response, if it has one.
+	response reflect.Type
+	// content is the media type of a response that is not JSON.
+	content string
+	// status is the status of a successful response, 200 if unset.
+	status int
+}
+
+var (
+	collectionParams = []string{"filter", "sort", "fields", "format", "repr", "tz", "include"}
+	objectParams     = []string{"repr", "tz", "include"}
+	longPollParams   = []string{"repr", "tz", "include", "wait_trigger", "wait_condition", "wait_timeout"}
+	// webhookList is what GET /webhooks lists for each webhook.
+	webhookList = reflect.TypeOf([]struct {
+		Name string      `json:"name"`
+		Rule WebhookRule `json:"rule"`
+	}{})
+)
+
+// apiOperations documents every route, by method and OpenAPI path. Routes
+// registered without methods are documented as GET. buildOpenAPI fails if
+// this and the router disagree.
+var apiOperations = map[string]apiOperation{
+	"GET /comments":                          {summary: "List comments", params: collectionParams, response: reflect.TypeOf([]Comment{})},
+	"GET /comments/{id}":                     {summary: "Get a comment", params: objectParams, response: reflect.TypeOf(Comment{})},
+	"GET /contacts":                          {summary: "List contacts", params: []string{"filter", "sort", "fields", "format"}, response: reflect.TypeOf([]Contact{})},
+	"GET /contacts/{name}":                   {summary: "Get a contact", response: reflect.TypeOf(Contact{})},
+	"GET /downtimes":                         {summary: "List downtimes", params: collectionParams, response: reflect.TypeOf([]Downtime{})},
+	"GET /downtimes/{id}":                    {summary: "Get a downtime", params: objectParams, response: reflect.TypeOf(Downtime{})},
+	"GET /hosts":                             {summary: "List hosts", params: collectionParams, response: reflect.TypeOf([]Host{})},
+	"GET /hosts/{name}":                      {summary: "Get a host", params: longPollParams, response: reflect.TypeOf(Host{})},
+	"PATCH /hosts/{name}":                    {summary: "Change a host", params: []string{"wait"}, body: reflect.TypeOf(objectPatch{}), response: reflect.TypeOf(Host{})},
+	"GET /services":                          {summary: "List services", params: collectionParams, response: reflect.TypeOf([]Service{})},
+	"GET /log":                               {summary: "List log entries, of the last day unless filtered on time", params: []string{"filter", "sort", "fields", "format", "repr", "tz"}, response: reflect.TypeOf([]LogEntry{})},
+	"GET /perfdata":                          {summary: "Export service perfdata for InfluxDB or Graphite", params: []string{"filter", "perfdata_format"}, content: "text/plain"},
+	"GET /topology":                          {summary: "Get the host parent graph", params: []string{"topology_format"}, response: reflect.TypeOf(Topology{})},
+	"GET /timing":                            {summary: "Summarize check latency and execution time", params: []string{"filter", "timing_table", "timing_by"}, response: reflect.TypeOf([]TimingStats{})},
+	"GET /hosts/{host_name}/services/{name}": {summary: "Get a service", params: longPollParams, response: reflect.TypeOf(Service{})},
+	"PATCH /hosts/{host_name}/services/{name}":             {summary: "Change a service", params: []string{"wait"}, body: reflect.TypeOf(objectPatch{}), response: reflect.TypeOf(Service{})},
+	"GET /hosts/{name}/perfdata":                           {summary: "Get a host's parsed perfdata", response: reflect.TypeOf([]PerfMetric{})},
+	"GET /hosts/{name}/parents":                            {summary: "List a host's parents", params: objectParams, response: reflect.TypeOf([]Host{})},
+	"GET /hosts/{name}/children":                           {summary: "List a host's children", params: objectParams, response: reflect.TypeOf([]Host{})},
+	"GET /hosts/{name}/impact":                             {summary: "List what a host's failure affects", response: reflect.TypeOf(ImpactResponse{})},
+	"GET /hosts/{name}/root-cause":                         {summary: "Find the failing objects behind a host problem", response: reflect.TypeOf(RootCauseResponse{})},
+	"GET /hosts/{host_name}/services/{name}/root-cause":    {summary: "Find the failing objects behind a service problem", response: reflect.TypeOf(RootCauseResponse{})},
+	"GET /hosts/{host_name}/services/{name}/perfdata":      {summary: "Get a service's parsed perfdata", response: reflect.TypeOf([]PerfMetric{})},
+	"POST /hosts/{name}/notification":                      {summary: "Send a custom host notification", body: reflect.TypeOf(notificationRequest{}), status: http.StatusAccepted},
+	"POST /hosts/{host_name}/services/{name}/notification": {summary: "Send a custom service notification", body: reflect.TypeOf(notificationRequest{}), status: http.StatusAccepted},
+	"GET /status":              {summary: "Get the program status", params: []string{"repr", "tz"}, response: reflect.TypeOf(Status{})},
+	"PATCH /status":            {summary: "Change program-wide settings", params: []string{"wait"}, body: reflect.TypeOf(statusPatch{}), response: reflect.TypeOf(Status{})},
+	"POST /bulk":               {summary: "Act on every host or service matching a filter", body: reflect.TypeOf(bulkRequest{}), response: reflect.TypeOf(BulkResponse{})},
+	"GET /events":              {summary: "Stream state changes as server-sent events", params: []string{"filter", "last_event_id"}, content: "text/event-stream"},
+	"GET /ws":                  {summary: "Subscribe to changes over a WebSocket", status: http.StatusSwitchingProtocols},
+	"GET /webhooks":            {summary: "List configured webhooks", response: webhookList},
+	"GET /webhooks/deliveries": {summary: "List recent webhook deliveries", response: reflect.TypeOf([]WebhookDelivery{})},
+	"GET /audit":               {summary: "List recent commands sent on behalf of clients", response: reflect.TypeOf([]AuditRecord{})},
+	"GET /metrics":             {summary: "Expose metrics for Prometheus", content: "text/plain; version=0.0.4"},
+	"GET /graphql":             {summary: "Run a GraphQL query given as query, operationName and variables", params: []string{"graphql_query"}, response: reflect.TypeOf(map[string]interface{}{})},
+	"POST /graphql":            {summary: "Run a GraphQL query, or a list of them", body: reflect.TypeOf(graphqlRequest{}), response: reflect.TypeOf(map[string]interface{}{})},
+	"GET /openapi.json":        {summary: "Get this document", response: reflect.TypeOf(map[string]interface{}{})},
+}
+
+// apiParameters are the query parameters shared between operations. Several
+// are named the same but take different values.
+var apiParameters = map[string]map[string]interface{}{
+	"filter": queryParam("filter", "Filter expression such as `state = 2`. Repeat it to match all of them. "+
+		"Hosts and services can also be filtered on custom variables with `custom.NAME=value`.",
+		map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}}),
+	"sort":            queryParam("sort", "Fields to order by, comma separated, such as `state,-last_check`. A leading - sorts descending.", stringSchema()),
+	"fields":          queryParam("fields", "Fields to return, comma separated, such as `name,state`. HAL links and embedded objects are kept.", stringSchema()),
+	"format":          queryParam("format", "Output format. Defaults to the Accept header, then json.", enumSchema(sortedKeys(formatTypes)...)),
+	"repr":            queryParam("repr", "human for state names, RFC3339 times and durations.", enumSchema("raw", "human")),
+	"tz":              queryParam("tz", "Time zone of human representation timestamps, such as Europe/Berlin.", stringSchema()),
+	"include":         queryParam("include", "Relations to embed in the HAL representation, comma separated, such as services,comments.", stringSchema()),
+	"wait":            queryParam("wait", "How long to wait for commands to take effect, such as 5s.", stringSchema()),
+	"wait_trigger":    queryParam("wait_trigger", "Livestatus event to wait for.", enumSchema(sortedKeys(waitTriggers)...)),
+	"wait_condition":  queryParam("wait_condition", "Filter expression to wait for. Repeat it to wait for all of them.", map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}}),
+	"wait_timeout":    queryParam("wait_timeout", "How long to wait, such as 30s.", stringSchema()),
+	"last_event_id":   queryParam("last_event_id", "Resume after this event, like the Last-Event-ID header.", stringSchema()),
+	"perfdata_format": queryParam("format", "Output format.", enumSchema(sortedKeys(perfDataTypes)...)),
+	"topology_format": queryParam("format", "Output format.", enumSchema("json", "dot", "graphml")),
+	"timing_table":    queryParam("table", "Whose checks to summarize.", enumSchema("services", "hosts")),
+	"graphql_query":   queryParam("query", "GraphQL query.", stringSchema()),
+	"timing_by":       queryParam("by", "How to group checks.", enumSchema(sortedKeys(timingGroupings)...)),
+}
+
+func queryParam(name, description string, schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"name": name, "in": "query", "description": description, "schema": schema}
+}
+
+func stringSchema() map[string]interface{} {
+	return map[string]interface{}{"type": "string"}
+}
+
+func enumSchema(values ...string) map[string]interface{} {
+	return map[string]interface{}{"type": "string", "enum": values}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// openAPISpec is the document served at /openapi.json, built by main once
+// every route is registered.
+var openAPISpec map[string]interface{}
+
+func getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, openAPISpec)
+}
+
+// pathVariable matches a mux path variable with an optional pattern, as in
+// {id:[0-9]+}.
+var pathVariable = regexp.MustCompile(`\{([^}:]+)(?::([^}]+))?\}`)
+
+// buildOpenAPI returns the OpenAPI 3 document for the routes of router. It
+// fails if a route is not in apiOperations or an operation has no route.
+func buildOpenAPI(router *mux.Router) (map[string]interface{}, error) {
+	b := &schemaBuilder{schemas: make(map[string]interface{})}
+	paths := make(map[string]map[string]interface{})
+	seen := make(map[string]bool)
+	var undocumented []string
+
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{http.MethodGet}
+		}
+
+		var params []interface{}
+		for _, m := range pathVariable.FindAllStringSubmatch(tmpl, -1) {
+			schema := stringSchema()
+			if m[2] == "[0-9]+" {
+				schema = map[string]interface{}{"type": "integer"}
+			} else if m[2] != "" {
+				schema["pattern"] = "^" + m[2] + "$"
+			}
+			params = append(params, map[string]interface{}{"name": m[1], "in": "path", "required": true, "schema": schema})
+		}
+		path := pathVariable.ReplaceAllString(tmpl, "{$1}")
+
+		for _, method := range methods {
+			if method == http.MethodHead {
+				// HEAD is answered as GET is and not documented apart.
+				continue
+			}
+			key := method + " " + path
+			op, ok := apiOperations[key]
+			if !ok {
+				undocumented = append(undocumented, key)
+				continue
+			}
+			seen[key] = true
+			if paths[path] == nil {
+				paths[path] = make(map[string]interface{})
+			}
+			paths[path][strings.ToLower(method)] = b.operation(op, handlerName(route.GetHandler()), params)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for key := range apiOperations {
+		if !seen[key] {
+			missing = append(missing, key)
+		}
+	}
+	if len(undocumented) > 0 || len(missing) > 0 {
+		sort.Strings(undocumented)
+		sort.Strings(missing)
+		return nil, fmt.Errorf("openapi: undocumented routes %q, documented operations without a route %q", undocumented, missing)
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Livestatus API",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas":    b.schemas,
+			"parameters": apiParameters,
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "The status code and a message, such as `404 - Host not found`.",
+					"content": map[string]interface{}{
+						"text/plain": map[string]interface{}{"schema": stringSchema()},
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// handlerName returns the name of the function serving a route, used as its
+// operation ID.
+func handlerName(h http.Handler) string {
+	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+func (b *schemaBuilder) operation(op apiOperation, id string, pathParams []interface{}) map[string]interface{} {
+	params := append([]interface{}(nil), pathParams...)
+	for _, name := range op.params {
+		params = append(params, map[string]interface{}{"$ref": "#/components/parameters/" + name})
+	}
+
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	switch {
+	case op.response != nil:
+		success["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": b.schema(op.response)},
+		}
+	case op.content != "":
+		success["content"] = map[string]interface{}{
+			op.content: map[string]interface{}{"schema": stringSchema()},
+		}
+	}
+
+	errorRef := map[string]interface{}{"$ref": "#/components/responses/Error"}
+	responses := map[string]interface{}{
+		fmt.Sprint(status): success,
+		"default":          errorRef,
+	}
+	if len(pathParams) > 0 {
+		responses["404"] = errorRef
+	}
+	for _, p := range op.params {
+		if p == "wait" {
+			// Commands that were sent but not confirmed in time.
+			responses["202"] = errorRef
+		}
+	}
+
+	o := map[string]interface{}{
+		"operationId": id,
+		"summary":     op.summary,
+		"responses":   responses,
+	}
+	if len(params) > 0 {
+		o["parameters"] = params
+	}
+	if op.body != nil {
+		o["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": b.schema(op.body)},
+			},
+		}
+	}
+	return o
+}
+
+// schemaBuilder derives JSON schemas from Go types the way encoding/json
+// encodes them. Named structs go in schemas and are referenced.
+type schemaBuilder struct {
+	schemas map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Ptr:
+		s := b.schema(t.Elem())
+		if _, ok := s["$ref"]; ok {
+			s = map[string]interface{}{"allOf": []interface{}{s}}
+		}
+		s["nullable"] = true
+		return s
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return stringSchema()
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		if _, ok := b.schemas[t.Name()]; !ok {
+			// Reserve the name first so recursive types terminate.
+			b.schemas[t.Name()] = nil
+			b.schemas[t.Name()] = b.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	// Interfaces may hold anything.
+	return map[string]interface{}{}
+}
+
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := jsonName(t.Field(i)); name != "" {
+			props[name] = b.schema(t.Field(i).Type)
+		}
+	}
+	return map[string]interface{}{"type": "object", "properties": props}
+}
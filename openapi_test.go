@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestOpenAPIMatchesRouter(t *testing.T) {
+	router := newRouter()
+	spec, err := buildOpenAPI(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var routes, documented []string
+	err = router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{http.MethodGet}
+		}
+		for _, m := range methods {
+			if m != http.MethodHead {
+				routes = append(routes, m+" "+pathVariable.ReplaceAllString(tmpl, "{$1}"))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, ops := range spec["paths"].(map[string]map[string]interface{}) {
+		for method := range ops {
+			documented = append(documented, strings.ToUpper(method)+" "+path)
+		}
+	}
+
+	sort.Strings(routes)
+	sort.Strings(documented)
+	if strings.Join(routes, "\n") != strings.Join(documented, "\n") {
+		t.Errorf("routes:\n%s\n\ndocumented:\n%s", strings.Join(routes, "\n"), strings.Join(documented, "\n"))
+	}
+}
+
+func TestOpenAPIDrift(t *testing.T) {
+	router := newRouter()
+	router.HandleFunc("/undocumented", getStatus)
+	spec, err := buildOpenAPI(router)
+	if err == nil || !strings.Contains(err.Error(), "GET /undocumented") {
+		t.Errorf("err = %v", err)
+	}
+	if spec != nil {
+		t.Error("got a document despite the drift")
+	}
+}
+
+func TestOpenAPICollectionParameters(t *testing.T) {
+	paths := openAPISpec["paths"].(map[string]map[string]interface{})
+	for _, path := range []string{"/hosts", "/services", "/comments", "/downtimes", "/contacts", "/log"} {
+		var refs []string
+		for _, p := range paths[path]["get"].(map[string]interface{})["parameters"].([]interface{}) {
+			if ref, ok := p.(map[string]interface{})["$ref"].(string); ok {
+				refs = append(refs, strings.TrimPrefix(ref, "#/components/parameters/"))
+			}
+		}
+		for _, want := range []string{"filter", "sort", "fields", "format"} {
+			if !containsString(refs, want) {
+				t.Errorf("GET %s does not document %s", path, want)
+			}
+		}
+	}
+}
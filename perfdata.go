@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// PerfMetric is one value of a plugin's performance data, as in
+// 'label'=value[UOM];[warn];[crit];[min];[max].
+type PerfMetric struct {
+	Label string `json:"label"`
+	// Value is nil when the plugin could not determine it ("U").
+	Value *float64   `json:"value"`
+	UOM   string     `json:"uom,omitempty"`
+	Warn  *PerfRange `json:"warn,omitempty"`
+	Crit  *PerfRange `json:"crit,omitempty"`
+	Min   *float64   `json:"min,omitempty"`
+	Max   *float64   `json:"max,omitempty"`
+}
+
+// PerfRange is a warning or critical threshold range. An alert is raised
+// when the value is outside of Start to End, or inside it if Inside is set.
+// A nil Start or End is unbounded.
+type PerfRange struct {
+	Start  *float64 `json:"start"`
+	End    *float64 `json:"end"`
+	Inside bool     `json:"inside"`
+}
+
+// perfValue matches a performance data value and its unit of measurement.
+var perfValue = regexp.MustCompile(`^([-+]?(?:[0-9]+(?:\.[0-9]*)?|\.[0-9]+)(?:[eE][-+]?[0-9]+)?)(.*)$`)
+
+// parsePerfData parses a plugin's performance data. Malformed entries are
+// skipped so that one bad label does not hide the others.
+func parsePerfData(s string) []PerfMetric {
+	metrics := []PerfMetric{}
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return metrics
+		}
+
+		var label string
+		if s[0] == '\'' {
+			// Quoted labels may contain spaces, and '' is a literal quote.
+			var b strings.Builder
+			i := 1
+			for ; i < len(s); i++ {
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						b.WriteByte('\'')
+						i++
+						continue
+					}
+					break
+				}
+				b.WriteByte(s[i])
+			}
+			label = b.String()
+			s = s[min(i+1, len(s)):]
+		} else {
+			i := strings.IndexAny(s, "= \t")
+			if i < 0 {
+				i = len(s)
+			}
+			label, s = s[:i], s[i:]
+		}
+
+		end := strings.IndexAny(s, " \t")
+		if end < 0 {
+			end = len(s)
+		}
+		data := s[:end]
+		s = s[end:]
+		if !strings.HasPrefix(data, "=") || label == "" {
+			continue
+		}
+		if m, ok := parsePerfMetric(label, data[1:]); ok {
+			metrics = append(metrics, m)
+		}
+	}
+}
+
+// parsePerfMetric parses the value[UOM];[warn];[crit];[min];[max] part of a
+// performance data entry.
+func parsePerfMetric(label, data string) (PerfMetric, bool) {
+	fields := strings.Split(data, ";")
+	m := PerfMetric{Label: label}
+
+	if fields[0] != "U" {
+		match := perfValue.FindStringSubmatch(strings.Replace(fields[0], ",", ".", 1))
+		if match == nil {
+			return m, false
+		}
+		v, _ := strconv.ParseFloat(match[1], 64)
+		m.Value, m.UOM = &v, match[2]
+	}
+	if len(fields) > 1 {
+		m.Warn = parsePerfRange(fields[1])
+	}
+	if len(fields) > 2 {
+		m.Crit = parsePerfRange(fields[2])
+	}
+	if len(fields) > 3 {
+		m.Min = parsePerfNumber(fields[3])
+	}
+	if len(fields) > 4 {
+		m.Max = parsePerfNumber(fields[4])
+	}
+	return m, true
+}
+
+// parsePerfRange parses a threshold range of the form [@][start:][end], where
+// a start of ~ is negative infinity and a missing start is 0.
+func parsePerfRange(s string) *PerfRange {
+	if s == "" {
+		return nil
+	}
+	r := &PerfRange{}
+	if strings.HasPrefix(s, "@") {
+		r.Inside = true
+		s = s[1:]
+	}
+
+	start, end, ok := strings.Cut(s, ":")
+	if !ok {
+		start, end = "0", s
+	}
+	if start != "~" {
+		if r.Start = parsePerfNumber(start); r.Start == nil && start != "" {
+			return nil
+		}
+		if start == "" {
+			zero := 0.0
+			r.Start = &zero
+		}
+	}
+	if r.End = parsePerfNumber(end); r.End == nil && end != "" {
+		return nil
+	}
+	return r
+}
+
+func parsePerfNumber(s string) *float64 {
+	v, err := strconv.ParseFloat(strings.Replace(s, ",", ".", 1), 64)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+func getHostPerfData(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	host, err := findHost(vars["name"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if host == nil {
+		writeError(w, http.StatusNotFound, "Host not found")
+		return
+	}
+
+	writeJSON(w, r, host.Metrics)
+}
+
+func getServicePerfData(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	service, err := findService(vars["host_name"], vars["name"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if service == nil {
+		writeError(w, http.StatusNotFound, "Service not found")
+		return
+	}
+
+	writeJSON(w, r, service.Metrics)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// objectRelation is a field of a resource type that holds the keys of
+// objects of another table, see queryTable. GraphQL resolves relations into
+// the objects, and the HAL representation links to them.
+type objectRelation struct {
+	name  string
+	table string
+	// one is set for relations to at most one object.
+	one bool
+	// keys returns the keys held by a value of the resource type.
+	keys func(v interface{}) []string
+}
+
+// objectRelations lists the relations of each resource type.
+var objectRelations = map[reflect.Type][]objectRelation{
+	reflect.TypeOf(Host{}): {
+		{name: "services", table: "services", keys: func(v interface{}) []string {
+			h := v.(Host)
+			return serviceKeys(h.Name, h.Services)
+		}},
+		{name: "comments", table: "comments", keys: func(v interface{}) []string { return idKeys(v.(Host).Comments) }},
+		{name: "downtimes", table: "downtimes", keys: func(v interface{}) []string { return idKeys(v.(Host).Downtimes) }},
+		{name: "contacts", table: "contacts", keys: func(v interface{}) []string { return v.(Host).Contacts }},
+		{name: "parents", table: "hosts", keys: func(v interface{}) []string { return v.(Host).Parents }},
+		{name: "children", table: "hosts", keys: func(v interface{}) []string { return v.(Host).Children }},
+	},
+	reflect.TypeOf(Service{}): {
+		{name: "host", table: "hosts", one: true, keys: func(v interface{}) []string { return []string{v.(Service).HostName} }},
+		{name: "comments", table: "comments", keys: func(v interface{}) []string { return idKeys(v.(Service).Comments) }},
+		{name: "downtimes", table: "downtimes", keys: func(v interface{}) []string { return idKeys(v.(Service).Downtimes) }},
+		{name: "contacts", table: "contacts", keys: func(v interface{}) []string { return v.(Service).Contacts }},
+	},
+	reflect.TypeOf(Comment{}):  annotationRelations,
+	reflect.TypeOf(Downtime{}): annotationRelations,
+}
+
+// annotationRelations are the relations of comments and downtimes to the
+// host or service they are about.
+var annotationRelations = []objectRelation{
+	{name: "host", table: "hosts", one: true, keys: func(v interface{}) []string {
+		hostName, _ := objectOf(v)
+		return []string{hostName}
+	}},
+	{name: "service", table: "services", one: true, keys: func(v interface{}) []string {
+		hostName, description := objectOf(v)
+		if description == "" {
+			return nil
+		}
+		return []string{hostName + ";" + description}
+	}},
+}
+
+// objectOf returns the host and service a comment or downtime is about.
+func objectOf(v interface{}) (string, string) {
+	switch o := v.(type) {
+	case Comment:
+		return o.HostName, o.ServiceDescription
+	case Downtime:
+		return o.HostName, o.ServiceDescription
+	}
+	return "", ""
+}
+
+func idKeys(ids []int) []string {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = strconv.Itoa(id)
+	}
+	return keys
+}
+
+func serviceKeys(hostName string, descriptions []string) []string {
+	keys := make([]string, len(descriptions))
+	for i, d := range descriptions {
+		keys[i] = hostName + ";" + d
+	}
+	return keys
+}
+
+// objectURL returns the path of the object of table with key.
+func objectURL(table, key string) string {
+	switch table {
+	case "hosts":
+		return hostURL(key)
+	case "services":
+		hostName, description, _ := strings.Cut(key, ";")
+		return serviceURL(hostName, description)
+	}
+	return "/" + table + "/" + url.PathEscape(key)
+}
+
+// objectLoader batches lookups of objects by key, so that related objects
+// cost one Livestatus query per table rather than one per object. Lookups
+// return thunks, and the first thunk called for a table loads every key
+// asked for so far. GraphQL resolvers return these thunks, which graphql-go
+// calls only once every sibling field has been resolved. It is not safe for
+// concurrent use.
+type objectLoader struct {
+	// pending holds, by table, the keys asked for but not loaded yet.
+	pending map[string][]string
+	// loaded holds, by table and key, the objects loaded so far, with nil
+	// for keys Livestatus does not know.
+	loaded map[string]map[string]interface{}
+}
+
+func newObjectLoader() *objectLoader {
+	return &objectLoader{
+		pending: make(map[string][]string),
+		loaded:  make(map[string]map[string]interface{}),
+	}
+}
+
+// load returns a thunk resolving to the objects of table with the given
+// keys, leaving out those that do not exist.
+func (l *objectLoader) load(table string, keys []string) func() (interface{}, error) {
+	for _, key := range keys {
+		if _, ok := l.loaded[table][key]; !ok {
+			l.pending[table] = append(l.pending[table], key)
+		}
+	}
+
+	return func() (interface{}, error) {
+		if err := l.flush(table); err != nil {
+			return nil, err
+		}
+		objs := []interface{}{}
+		for _, key := range keys {
+			if o := l.loaded[table][key]; o != nil {
+				objs = append(objs, o)
+			}
+		}
+		return objs, nil
+	}
+}
+
+// loadOne returns a thunk resolving to the object of table with key, or nil.
+func (l *objectLoader) loadOne(table, key string) func() (interface{}, error) {
+	thunk := l.load(table, []string{key})
+	return func() (interface{}, error) {
+		objs, err := thunk()
+		if err != nil || len(objs.([]interface{})) == 0 {
+			return nil, err
+		}
+		return objs.([]interface{})[0], nil
+	}
+}
+
+// flush loads the pending keys of table in one query.
+func (l *objectLoader) flush(table string) error {
+	keys := l.pending[table]
+	delete(l.pending, table)
+	if l.loaded[table] == nil {
+		l.loaded[table] = make(map[string]interface{})
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, key := range keys {
+		if _, ok := l.loaded[table][key]; ok {
+			continue
+		}
+		l.loaded[table][key] = nil
+		b.WriteString(keyFilter(table, key))
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	if n > 1 {
+		fmt.Fprintf(&b, "Or: %d\n", n)
+	}
+
+	rows, rowKeys, err := queryTable(table, b.String())
+	if err != nil {
+		return err
+	}
+	l.add(table, rows, rowKeys)
+	return nil
+}
+
+// add remembers rows of table so later lookups need no query.
+func (l *objectLoader) add(table string, rows []interface{}, keys []string) {
+	if l.loaded[table] == nil {
+		l.loaded[table] = make(map[string]interface{})
+	}
+	for i, row := range rows {
+		l.loaded[table][keys[i]] = row
+	}
+}
+
+// keyFilter returns the Livestatus filter matching the object of table with
+// key, see queryTable.
+func keyFilter(table, key string) string {
+	switch table {
+	case "comments", "downtimes":
+		return "Filter: id = " + key + "\n"
+	case "services":
+		hostName, description, _ := strings.Cut(key, ";")
+		return fmt.Sprintf("Filter: host_name = %s\nFilter: description = %s\nAnd: 2\n", hostName, description)
+	}
+	return "Filter: name = " + key + "\n"
+}
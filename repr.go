@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// reprLocation is the time zone of human representation timestamps, from
+// -repr.timezone.
+var reprLocation = time.Local
+
+var (
+	stateTypeNames         = []string{"SOFT", "HARD"}
+	checkTypeNames         = []string{"ACTIVE", "PASSIVE"}
+	commentEntryNames      = []string{1: "USER", 2: "DOWNTIME", 3: "FLAPPING", 4: "ACKNOWLEDGEMENT"}
+	commentTypeNames       = []string{1: "HOST", 2: "SERVICE"}
+	downtimeTypeNames      = []string{"ACTIVE", "PENDING"}
+	logClassNames          = []string{"INFO", "ALERT", "PROGRAM", "NOTIFICATION", "PASSIVE", "COMMAND", "STATE"}
+	humanHostStateNames    = upper(hostStateNames)
+	humanServiceStateNames = upper(serviceStateNames)
+)
+
+func upper(names []string) []string {
+	out := make([]string, len(names))
+	for i, n := range names {
+		out[i] = strings.ToUpper(n)
+	}
+	return out
+}
+
+// parseRepr returns the time zone to render a human representation in, or
+// nil if r asked for the raw one. The human representation is chosen with
+// repr=human or an Accept profile of human, and tz overrides the time zone.
+func parseRepr(w http.ResponseWriter, r *http.Request) (*time.Location, error) {
+	varyAccept(w)
+
+	repr := r.URL.Query().Get("repr")
+	if repr == "" {
+		for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+			if _, params, err := mime.ParseMediaType(accept); err == nil && params["profile"] == "human" {
+				repr = "human"
+			}
+		}
+	}
+	switch repr {
+	case "", "raw":
+		return nil, nil
+	case "human":
+	default:
+		return nil, fmt.Errorf("unknown repr %q", repr)
+	}
+
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		return time.LoadLocation(tz)
+	}
+	return reprLocation, nil
+}
+
+func varyAccept(w http.ResponseWriter) {
+	if !slices.Contains(w.Header().Values("Vary"), "Accept") {
+		w.Header().Add("Vary", "Accept")
+	}
+}
+
+// humanizers rewrite the JSON fields of a type for the human representation.
+var humanizers = map[reflect.Type]func(m map[string]interface{}, loc *time.Location){
+	reflect.TypeOf(Host{}):     humanizeHost,
+	reflect.TypeOf(Service{}):  humanizeService,
+	reflect.TypeOf(Comment{}):  humanizeComment,
+	reflect.TypeOf(Downtime{}): humanizeDowntime,
+	reflect.TypeOf(LogEntry{}): humanizeLogEntry,
+	reflect.TypeOf(Status{}):   humanizeStatus,
+}
+
+// represent returns v in the human representation if loc is set and the HAL
+// one if hal is: state names instead of numbers, RFC3339 timestamps in loc
+// and computed durations, or links to and embedded related objects, see
+// halView. Values of other types, and lists of them, encode as they did.
+func represent(v interface{}, loc *time.Location, hal *halView) interface{} {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return v
+		}
+		return represent(rv.Elem().Interface(), loc, hal)
+	case reflect.Slice:
+		if rv.IsNil() || rv.Type().Elem().Kind() == reflect.Uint8 {
+			return v
+		}
+		out := make([]interface{}, rv.Len())
+		for i := range out {
+			out[i] = represent(rv.Index(i).Interface(), loc, hal)
+		}
+		return out
+	}
+
+	h, human := humanizers[rv.Type()]
+	human = human && loc != nil
+	_, _, object := objectKey(v)
+	object = object && hal != nil
+	if !human && !object {
+		return v
+	}
+	m := fieldsOf(v)
+	if human {
+		h(m, loc)
+	}
+	if object {
+		hal.decorate(m, v, loc)
+	}
+	return m
+}
+
+func humanizeHost(m map[string]interface{}, loc *time.Location) {
+	humanizeObject(m, loc, humanHostStateNames)
+	humanTimes(m, loc, "last_time_down", "last_time_unreachable", "last_time_up")
+}
+
+func humanizeService(m map[string]interface{}, loc *time.Location) {
+	humanizeObject(m, loc, humanServiceStateNames)
+	humanName(m, "check_type", checkTypeNames)
+	humanTimes(m, loc, "last_time_critical", "last_time_ok", "last_time_unknown", "last_time_warning")
+}
+
+// humanizeObject rewrites the fields hosts and services have in common.
+// Objects that have not been checked yet are PENDING.
+func humanizeObject(m map[string]interface{}, loc *time.Location, states []string) {
+	m["state_duration"] = humanSince(m["last_state_change"])
+	if checked, _ := m["has_been_checked"].(bool); checked {
+		humanName(m, "state", states)
+		humanName(m, "hard_state", states)
+	} else {
+		m["state"] = "PENDING"
+		if _, ok := m["hard_state"]; ok {
+			m["hard_state"] = "PENDING"
+		}
+	}
+	humanName(m, "state_type", stateTypeNames)
+	humanTimes(m, loc, "last_check", "last_notification", "last_state_change", "next_check", "next_notification")
+}
+
+func humanizeComment(m map[string]interface{}, loc *time.Location) {
+	humanName(m, "entry_type", commentEntryNames)
+	humanName(m, "type", commentTypeNames)
+	humanTimes(m, loc, "entry_time", "expire_time")
+}
+
+func humanizeDowntime(m map[string]interface{}, loc *time.Location) {
+	humanName(m, "type", downtimeTypeNames)
+	humanTimes(m, loc, "start_time", "end_time", "entry_time")
+	if d, ok := m["duration"].(float64); ok {
+		m["duration"] = humanDuration(d)
+	}
+}
+
+func humanizeLogEntry(m map[string]interface{}, loc *time.Location) {
+	if m["service_description"] == "" {
+		humanName(m, "state", humanHostStateNames)
+	} else {
+		humanName(m, "state", humanServiceStateNames)
+	}
+	humanName(m, "class", logClassNames)
+	humanTimes(m, loc, "time")
+}
+
+func humanizeStatus(m map[string]interface{}, loc *time.Location) {
+	m["uptime"] = humanSince(m["program_start"])
+	humanTimes(m, loc, "program_start")
+}
+
+// humanName replaces the number in m[key] with its name, if it has one.
+func humanName(m map[string]interface{}, key string, names []string) {
+	n, ok := m[key].(float64)
+	if ok && n >= 0 && int(n) < len(names) && names[int(n)] != "" {
+		m[key] = names[int(n)]
+	}
+}
+
+// humanTimes replaces the Unix timestamps in m with RFC3339 times in loc.
+// Zero, which Livestatus uses for never, becomes null.
+func humanTimes(m map[string]interface{}, loc *time.Location, keys ...string) {
+	for _, key := range keys {
+		t, ok := m[key].(float64)
+		if !ok {
+			continue
+		}
+		if t <= 0 {
+			m[key] = nil
+		} else {
+			m[key] = time.Unix(int64(t), 0).In(loc).Format(time.RFC3339)
+		}
+	}
+}
+
+// humanSince returns how long ago the Unix timestamp t was, or nil if it is
+// unset.
+func humanSince(t interface{}) interface{} {
+	ts, ok := t.(float64)
+	if !ok || ts <= 0 {
+		return nil
+	}
+	return humanDuration(time.Since(time.Unix(int64(ts), 0)).Seconds())
+}
+
+func humanDuration(seconds float64) string {
+	return (time.Duration(seconds) * time.Second).String()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// rowSelection is the order and the fields of the rows a collection request
+// asked for with its sort and fields parameters.
+type rowSelection struct {
+	sort []sortKey
+	// fields are the JSON fields to return, all of them if empty.
+	fields []string
+}
+
+// sortKey is one field of a sort parameter, by its index in the table's
+// struct.
+type sortKey struct {
+	index int
+	desc  bool
+}
+
+// listParam returns the values of the comma separated list parameter name.
+func listParam(r *http.Request, name string) []string {
+	var list []string
+	for _, v := range r.URL.Query()[name] {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// parseSelection returns the sort and fields parameters of r for table. Both
+// are lists of JSON field names; sort fields prefixed with - sort in
+// descending order and must hold numbers, strings or booleans.
+func parseSelection(r *http.Request, table string) (*rowSelection, error) {
+	t := tableTypes[table]
+	sel := &rowSelection{}
+	for _, name := range listParam(r, "sort") {
+		desc := strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+		i, ok := fieldIndex(t, name)
+		if !ok {
+			return nil, fmt.Errorf("%s have no field %q", table, name)
+		}
+		if !sortable(t.Field(i).Type.Kind()) {
+			return nil, fmt.Errorf("%s cannot be sorted by %s", table, name)
+		}
+		sel.sort = append(sel.sort, sortKey{i, desc})
+	}
+	for _, name := range listParam(r, "fields") {
+		if _, ok := fieldIndex(t, name); !ok {
+			return nil, fmt.Errorf("%s have no field %q", table, name)
+		}
+		sel.fields = append(sel.fields, name)
+	}
+	return sel, nil
+}
+
+// fieldIndex returns the index of the field of t encoded as name in JSON.
+func fieldIndex(t reflect.Type, name string) (int, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if jsonName(t.Field(i)) == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func sortable(k reflect.Kind) bool {
+	switch k {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// sortRows orders rows, values or pointers of the table's type, by the sort
+// keys. Rows that compare equal keep their order.
+func (sel *rowSelection) sortRows(rows []interface{}) {
+	if len(sel.sort) == 0 {
+		return
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		a := reflect.Indirect(reflect.ValueOf(rows[i]))
+		b := reflect.Indirect(reflect.ValueOf(rows[j]))
+		for _, k := range sel.sort {
+			if c := compareFields(a.Field(k.index), b.Field(k.index)); c != 0 {
+				return (c < 0) != k.desc
+			}
+		}
+		return false
+	})
+}
+
+// compareFields compares two values of a sortable kind, with false before
+// true.
+func compareFields(a, b reflect.Value) int {
+	switch a.Kind() {
+	case reflect.Bool:
+		if a.Bool() == b.Bool() {
+			return 0
+		} else if b.Bool() {
+			return -1
+		}
+		return 1
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cmp.Compare(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return cmp.Compare(a.Uint(), b.Uint())
+	case reflect.Float32, reflect.Float64:
+		return cmp.Compare(a.Float(), b.Float())
+	}
+	return strings.Compare(a.String(), b.String())
+}
+
+// project returns the selected fields of a row's JSON fields m, keeping the
+// HAL _links and _embedded members.
+func (sel *rowSelection) project(m map[string]interface{}) map[string]interface{} {
+	if len(sel.fields) == 0 {
+		return m
+	}
+	only := append(sel.fields[:len(sel.fields):len(sel.fields)], "_links", "_embedded")
+	return onlyFields(m, only)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snapshot is the state of every host and service at one point in time.
+// Snapshots are shared between subscribers and must not be modified.
+type snapshot struct {
+	taken    time.Time
+	hosts    []Host
+	services []Service
+	// fields holds the JSON fields of every object by table and key, see
+	// hostKey and serviceKey.
+	fields map[string]map[string]map[string]interface{}
+}
+
+func hostKey(h *Host) string {
+	return h.Name
+}
+
+func serviceKey(s *Service) string {
+	return s.HostName + ";" + s.Description
+}
+
+// takeSnapshot reads every host and service from Livestatus.
+func takeSnapshot() (*snapshot, error) {
+	hosts, err := queryHosts("")
+	if err != nil {
+		return nil, err
+	}
+	services, err := queryServices("")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &snapshot{
+		taken:    time.Now(),
+		hosts:    hosts,
+		services: services,
+		fields: map[string]map[string]map[string]interface{}{
+			"hosts":    make(map[string]map[string]interface{}, len(hosts)),
+			"services": make(map[string]map[string]interface{}, len(services)),
+		},
+	}
+	for i := range hosts {
+		s.fields["hosts"][hostKey(&hosts[i])] = fieldsOf(&hosts[i])
+	}
+	for i := range services {
+		s.fields["services"][serviceKey(&services[i])] = fieldsOf(&services[i])
+	}
+	return s, nil
+}
+
+// watcher polls Livestatus for snapshots while anything is subscribed to
+// them. Subscribers are only ever sent the latest snapshot, so slow ones skip
+// intermediate states rather than hold up the others.
+type watcher struct {
+	mu      sync.Mutex
+	subs    map[chan *snapshot]bool
+	latest  *snapshot
+	running bool
+}
+
+var stateWatcher = &watcher{subs: make(map[chan *snapshot]bool)}
+
+// subscribe returns a channel that receives each new snapshot, starting the
+// poller if needed.
+func (w *watcher) subscribe() chan *snapshot {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ch := make(chan *snapshot, 1)
+	w.subs[ch] = true
+	if w.latest != nil {
+		ch <- w.latest
+	}
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+	return ch
+}
+
+// unsubscribe stops sending snapshots to ch. The poller stops once nothing is
+// subscribed.
+func (w *watcher) unsubscribe(ch chan *snapshot) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.subs, ch)
+}
+
+func (w *watcher) run() {
+	ticker := time.NewTicker(*watchInterval)
+	defer ticker.Stop()
+
+	for {
+		s, err := takeSnapshot()
+		if err != nil {
+			log.Printf("watcher: %v", err)
+		}
+
+		w.mu.Lock()
+		if len(w.subs) == 0 {
+			w.running = false
+			w.latest = nil
+			w.mu.Unlock()
+			return
+		}
+		if s != nil {
+			w.latest = s
+			for ch := range w.subs {
+				// Replace a snapshot the subscriber has not read yet.
+				select {
+				case <-ch:
+				default:
+				}
+				ch <- s
+			}
+		}
+		w.mu.Unlock()
+
+		<-ticker.C
+	}
+}
+
+// fieldChange is one changed field of an object. op is the JSON Patch
+// operation for it: add for a field that is new, remove for one that is
+// gone, and replace otherwise.
+type fieldChange struct {
+	field    string
+	op       string
+	old, new interface{}
+}
+
+// changedFields returns the fields that differ between old and new, limited
+// to only if it is not empty.
+func changedFields(old, new map[string]interface{}, only []string) []fieldChange {
+	var changes []fieldChange
+	for field, v := range new {
+		if len(only) > 0 && !containsString(only, field) {
+			continue
+		}
+		before, ok := old[field]
+		if !ok {
+			changes = append(changes, fieldChange{field, "add", nil, v})
+		} else if !reflect.DeepEqual(before, v) {
+			changes = append(changes, fieldChange{field, "replace", before, v})
+		}
+	}
+	for field, v := range old {
+		if len(only) > 0 && !containsString(only, field) {
+			continue
+		}
+		if _, ok := new[field]; !ok {
+			changes = append(changes, fieldChange{field, "remove", v, nil})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].field < changes[j].field })
+	return changes
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonPointer escapes a field name for use as a JSON Pointer path.
+func jsonPointer(field string) string {
+	return "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(field)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+)
+
+// streamRows copies a Livestatus JSON response for table to w one row at a
+// time in format, so collections are never held in memory in full. JSON
+// output is the same as encoding the decoded slice. Errors after the first
+// row can only be signalled by cutting the response short, and the ETag
+// follows the body as a trailer. Sorted rows and rows embedding related
+// objects are read in full first, so they can be ordered and the related
+// objects fetched together, and so are conditional requests, which may be
+// answered with 304 Not Modified.
+func streamRows(w http.ResponseWriter, r *http.Request, raw io.Reader, table, format string) {
+	loc, err := parseRepr(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	hal := parseHAL(w, r)
+	sel, err := parseSelection(r, table)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	t := tableTypes[table]
+	dec := json.NewDecoder(raw)
+	if _, err := dec.Token(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	conditional := r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+	if (hal != nil && len(hal.include) > 0 && format != "csv") || len(sel.sort) > 0 || conditional {
+		var rows []interface{}
+		for dec.More() {
+			row := reflect.New(t).Interface()
+			if err := dec.Decode(row); err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			rows = append(rows, row)
+		}
+		writeRows(w, r, table, format, rows)
+		return
+	}
+
+	if ct := formatTypes[format]; ct != "" {
+		w.Header().Set("Content-Type", ct)
+	} else if hal != nil {
+		w.Header().Set("Content-Type", "application/hal+json")
+	}
+	w.Header().Set("Trailer", "ETag")
+	sum := sha256.New()
+	rw := newRowWriter(io.MultiWriter(w, sum), table, format, loc, hal, sel)
+	for n := 0; dec.More(); n++ {
+		row := reflect.New(t).Interface()
+		err := dec.Decode(row)
+		if err == nil {
+			err = rw.write(row)
+		}
+		if err != nil && n == 0 {
+			// Nothing has been sent yet, as rw buffers.
+			w.Header().Del("Content-Type")
+			w.Header().Del("Trailer")
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("streaming %s: %v", table, err)
+			return
+		}
+	}
+	if rw.close() == nil {
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum.Sum(nil)))
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// perfDataTypes maps the formats of /perfdata to their content types.
+var perfDataTypes = map[string]string{
+	"influx":   "text/plain; charset=utf-8",
+	"graphite": "text/plain; charset=utf-8",
+}
+
+// writeInflux writes the services' metrics in InfluxDB line protocol with
+// second precision, one point per metric in the perfdata measurement.
+// Services that have not been checked yet are left out, here and in
+// writeGraphite.
+func writeInflux(w io.Writer, services []Service) {
+	for i := range services {
+		s := &services[i]
+		if s.LastCheck == 0 {
+			continue
+		}
+		groups := append([]string(nil), s.Groups...)
+		sort.Strings(groups)
+
+		for _, m := range s.Metrics {
+			if m.Value == nil {
+				continue
+			}
+
+			fmt.Fprintf(w, "perfdata,host=%s,service=%s,metric=%s",
+				influxTag(s.HostName), influxTag(s.Description), influxTag(m.Label))
+			if len(groups) > 0 {
+				fmt.Fprintf(w, ",groups=%s", influxTag(strings.Join(groups, ",")))
+			}
+			if m.UOM != "" {
+				fmt.Fprintf(w, ",unit=%s", influxTag(m.UOM))
+			}
+
+			fields := []string{"value=" + influxFloat(*m.Value)}
+			for _, f := range []struct {
+				name string
+				r    *PerfRange
+			}{{"warn", m.Warn}, {"crit", m.Crit}} {
+				if f.r != nil && f.r.Start != nil {
+					fields = append(fields, f.name+"_start="+influxFloat(*f.r.Start))
+				}
+				if f.r != nil && f.r.End != nil {
+					fields = append(fields, f.name+"_end="+influxFloat(*f.r.End))
+				}
+			}
+			if m.Min != nil {
+				fields = append(fields, "min="+influxFloat(*m.Min))
+			}
+			if m.Max != nil {
+				fields = append(fields, "max="+influxFloat(*m.Max))
+			}
+			fmt.Fprintf(w, " %s %d\n", strings.Join(fields, ","), s.LastCheck)
+		}
+	}
+}
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+
+// influxTag escapes a tag value, which may not be empty.
+func influxTag(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return influxTagEscaper.Replace(s)
+}
+
+func influxFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeGraphite writes the services' metric values in Graphite's plaintext
+// protocol as host.service.label.
+func writeGraphite(w io.Writer, services []Service) {
+	for i := range services {
+		s := &services[i]
+		if s.LastCheck == 0 {
+			continue
+		}
+		for _, m := range s.Metrics {
+			if m.Value == nil {
+				continue
+			}
+			fmt.Fprintf(w, "%s.%s.%s %s %d\n",
+				graphiteNode(s.HostName), graphiteNode(s.Description), graphiteNode(m.Label),
+				influxFloat(*m.Value), s.LastCheck)
+		}
+	}
+}
+
+var graphiteUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// graphiteNode makes s safe to use as one node of a Graphite path.
+func graphiteNode(s string) string {
+	return graphiteUnsafe.ReplaceAllString(s, "_")
+}
+
+func getPerfData(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "influx"
+	}
+	if _, ok := perfDataTypes[format]; !ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown format %q", format))
+		return
+	}
+
+	filters, err := parseFilters("services", r.URL.Query()["filter"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	custom, err := parseCustomFilters(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filters += customFilters(custom)
+	services, err := queryServices(filters)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", perfDataTypes[format])
+	if format == "graphite" {
+		writeGraphite(w, services)
+	} else {
+		writeInflux(w, services)
+	}
+}
+
+// pushTimeout bounds each InfluxDB write.
+const pushTimeout = 30 * time.Second
+
+var pushClient = &http.Client{Timeout: pushTimeout}
+
+// pushPerfData periodically writes the perfdata of every service to target,
+// an InfluxDB write URL (http or https) or a Graphite plaintext listener
+// (tcp://host:port). A push is abandoned when the next one is due.
+func pushPerfData(target *url.URL, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		if err := pushOnce(target, interval); err != nil {
+			log.Printf("perfdata push to %s: %v", target.Redacted(), err)
+		}
+	}
+}
+
+// pushOnce writes the perfdata of every service to target, giving up after
+// interval.
+func pushOnce(target *url.URL, interval time.Duration) error {
+	services, err := queryServices("")
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), interval)
+	defer cancel()
+
+	var b bytes.Buffer
+	if target.Scheme == "tcp" {
+		writeGraphite(&b, services)
+		return pushGraphite(ctx, target.Host, b.Bytes())
+	}
+	writeInflux(&b, services)
+	return pushInflux(ctx, target.String(), b.Bytes())
+}
+
+func pushInflux(ctx context.Context, target string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+func pushGraphite(ctx context.Context, addr string, body []byte) error {
+	d := net.Dialer{Timeout: *timeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(*timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	_, err = conn.Write(body)
+	return err
+}
+
+// parsePushURL checks a -perfdata.push-url, adding second precision to
+// InfluxDB URLs as that is what is written.
+func parsePushURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		q := u.Query()
+		q.Set("precision", "s")
+		u.RawQuery = q.Encode()
+	case "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("perfdata push URL %q has no host", s)
+		}
+	default:
+		return nil, fmt.Errorf("perfdata push URL %q must be http, https or tcp", s)
+	}
+	return u, nil
+}
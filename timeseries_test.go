@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// perfDataTables has one checked service with a metric and one unchecked.
+func perfDataTables() mockTables {
+	return mockTables{
+		"services": {
+			{"host_name": "web01", "description": "HTTP", "groups": []string{"web"}, "last_check": 1700000000,
+				"has_been_checked": true, "perf_data": "time=0.5s;1;2;0"},
+			{"host_name": "db01", "description": "MySQL", "perf_data": "conns=3"},
+		},
+	}
+}
+
+func TestPushInflux(t *testing.T) {
+	startMock(t, perfDataTables())
+
+	var body, contentType, query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body, contentType, query = string(b), r.Header.Get("Content-Type"), r.URL.RawQuery
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	target, err := parsePushURL(srv.URL + "/write?db=naemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pushOnce(target, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	want := "perfdata,host=web01,service=HTTP,metric=time,groups=web,unit=s value=0.5,warn_start=0,warn_end=1,crit_start=0,crit_end=2,min=0 1700000000\n"
+	if body != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+	if contentType != "text/plain; charset=utf-8" || query != "db=naemon&precision=s" {
+		t.Errorf("Content-Type %q, query %q", contentType, query)
+	}
+}
+
+func TestPushInfluxTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := pushInflux(ctx, srv.URL, nil); err == nil {
+		t.Error("push to a hung server succeeded")
+	}
+}
+
+func TestPushGraphite(t *testing.T) {
+	startMock(t, perfDataTables())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		received <- string(b)
+	}()
+
+	if err := pushOnce(&url.URL{Scheme: "tcp", Host: l.Addr().String()}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := <-received, "web01.HTTP.time 0.5 1700000000\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
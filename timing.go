@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// hostTimingColumns and serviceTimingColumns list the columns
+// objectTiming.UnmarshalJSON expects. Services have a description after the
+// host name, and are grouped by their host's groups.
+const (
+	hostTimingColumns    = "name groups check_command has_been_checked latency execution_time"
+	serviceTimingColumns = "host_name description host_groups check_command has_been_checked latency execution_time"
+)
+
+// timingGroupings are the ways /timing can group checks.
+var timingGroupings = map[string]bool{"command": true, "group": true}
+
+// objectTiming is how long a host or service check waited and ran.
+type objectTiming struct {
+	HostName      string
+	Description   string
+	Groups        []string
+	Command       string
+	Checked       bool
+	Latency       float64
+	ExecutionTime float64
+}
+
+func (t *objectTiming) UnmarshalJSON(b []byte) (err error) {
+	var tmp []interface{}
+
+	if err := json.Unmarshal(b, &tmp); err != nil {
+		return err
+	}
+
+	t.HostName = tmp[0].(string)
+	if len(tmp) == len(strings.Fields(serviceTimingColumns)) {
+		t.Description = tmp[1].(string)
+		tmp = tmp[1:]
+	}
+	for _, g := range tmp[1].([]interface{}) {
+		t.Groups = append(t.Groups, g.(string))
+	}
+	// Arguments follow the command name after "!".
+	t.Command, _, _ = strings.Cut(tmp[2].(string), "!")
+	t.Checked = tmp[3].(float64) != 0
+	t.Latency = tmp[4].(float64)
+	t.ExecutionTime = tmp[5].(float64)
+
+	return nil
+}
+
+// Percentiles summarizes a set of durations in seconds.
+type Percentiles struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+// percentiles summarizes values, which it sorts. Percentiles use the nearest
+// rank method, so they are always one of the values.
+func percentiles(values []float64) Percentiles {
+	sort.Float64s(values)
+	rank := func(p float64) float64 {
+		return values[max(int(math.Ceil(p/100*float64(len(values))))-1, 0)]
+	}
+
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return Percentiles{
+		Min:  values[0],
+		Mean: sum / float64(len(values)),
+		P50:  rank(50),
+		P90:  rank(90),
+		P95:  rank(95),
+		P99:  rank(99),
+		Max:  values[len(values)-1],
+	}
+}
+
+// TimingStats is the check timing of one host group or check command.
+type TimingStats struct {
+	Name          string      `json:"name"`
+	Count         int         `json:"count"`
+	Latency       Percentiles `json:"latency"`
+	ExecutionTime Percentiles `json:"execution_time"`
+}
+
+// timingStats groups the checked objects by check command or group and
+// summarizes each, slowest 95th percentile execution time first. Objects in
+// several groups count towards each of them, and those in none are under
+// the empty name.
+func timingStats(objs []objectTiming, by string) []TimingStats {
+	latency := make(map[string][]float64)
+	execution := make(map[string][]float64)
+	for i := range objs {
+		o := &objs[i]
+		if !o.Checked {
+			continue
+		}
+		names := []string{o.Command}
+		if by == "group" {
+			names = o.Groups
+			if len(names) == 0 {
+				names = []string{""}
+			}
+		}
+		for _, name := range names {
+			latency[name] = append(latency[name], o.Latency)
+			execution[name] = append(execution[name], o.ExecutionTime)
+		}
+	}
+
+	stats := []TimingStats{}
+	for name := range latency {
+		stats = append(stats, TimingStats{
+			Name:          name,
+			Count:         len(latency[name]),
+			Latency:       percentiles(latency[name]),
+			ExecutionTime: percentiles(execution[name]),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].ExecutionTime.P95 != stats[j].ExecutionTime.P95 {
+			return stats[i].ExecutionTime.P95 > stats[j].ExecutionTime.P95
+		}
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+func getTiming(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	table := q.Get("table")
+	if table == "" {
+		table = "services"
+	}
+	if table != "hosts" && table != "services" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown table %q", table))
+		return
+	}
+	by := q.Get("by")
+	if by == "" {
+		by = "command"
+	}
+	if !timingGroupings[by] {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown grouping %q", by))
+		return
+	}
+	filters, err := parseFilters(table, q["filter"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	custom, err := parseCustomFilters(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filters += customFilters(custom)
+
+	columns := serviceTimingColumns
+	if table == "hosts" {
+		columns = hostTimingColumns
+	}
+	raw, err := query("GET " + table + "\n" + filters + "Columns: " + columns)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer raw.Close()
+
+	var objs []objectTiming
+	if err := json.NewDecoder(raw).Decode(&objs); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, r, timingStats(objs, by))
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// hostColors are the fill colors of topology nodes by host state, with grey
+// for hosts that have not been checked yet.
+var hostColors = []string{"#4caf50", "#f44336", "#ff9800"}
+
+const pendingColor = "#9e9e9e"
+
+// TopologyNode is a host in the parent graph.
+type TopologyNode struct {
+	ID        string `json:"id"`
+	Alias     string `json:"alias"`
+	State     int    `json:"state"`
+	StateName string `json:"state_name"`
+	Color     string `json:"color"`
+}
+
+// TopologyEdge points from a parent host to one of its children.
+type TopologyEdge struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+type Topology struct {
+	Nodes []TopologyNode `json:"nodes"`
+	Edges []TopologyEdge `json:"edges"`
+}
+
+func topologyNode(h *Host) TopologyNode {
+	n := TopologyNode{ID: h.Name, Alias: h.Alias, State: h.State, StateName: "pending", Color: pendingColor}
+	if h.HasBeenChecked && h.State >= 0 && h.State < len(hostStateNames) {
+		n.StateName = hostStateNames[h.State]
+		n.Color = hostColors[h.State]
+	}
+	return n
+}
+
+// buildTopology returns the parent graph of hosts. Edges to hosts that are
+// not among them are left out.
+func buildTopology(hosts []Host) Topology {
+	t := Topology{Nodes: []TopologyNode{}, Edges: []TopologyEdge{}}
+	known := make(map[string]bool, len(hosts))
+	for i := range hosts {
+		known[hosts[i].Name] = true
+	}
+	for i := range hosts {
+		t.Nodes = append(t.Nodes, topologyNode(&hosts[i]))
+		for _, p := range hosts[i].Parents {
+			if known[p] {
+				t.Edges = append(t.Edges, TopologyEdge{Source: p, Target: hosts[i].Name})
+			}
+		}
+	}
+	return t
+}
+
+// writeDOT writes t as a Graphviz digraph.
+func writeDOT(w io.Writer, t Topology) {
+	fmt.Fprintln(w, "digraph topology {")
+	fmt.Fprintln(w, "\tnode [style=filled];")
+	for _, n := range t.Nodes {
+		fmt.Fprintf(w, "\t%s [label=%s, fillcolor=%s, tooltip=%s];\n",
+			strconv.Quote(n.ID), strconv.Quote(n.ID+"\n"+n.StateName), strconv.Quote(n.Color), strconv.Quote(n.Alias))
+	}
+	for _, e := range t.Edges {
+		fmt.Fprintf(w, "\t%s -> %s;\n", strconv.Quote(e.Source), strconv.Quote(e.Target))
+	}
+	fmt.Fprintln(w, "}")
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string `xml:"source,attr"`
+	Target string `xml:"target,attr"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// writeGraphML writes t as GraphML with each node's alias, state and color.
+func writeGraphML(w io.Writer, t Topology) error {
+	g := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{ID: "alias", For: "node", Name: "alias", Type: "string"},
+			{ID: "state", For: "node", Name: "state", Type: "int"},
+			{ID: "state_name", For: "node", Name: "state_name", Type: "string"},
+			{ID: "color", For: "node", Name: "color", Type: "string"},
+		},
+		Graph: graphMLGraph{ID: "topology", EdgeDefault: "directed"},
+	}
+	for _, n := range t.Nodes {
+		g.Graph.Nodes = append(g.Graph.Nodes, graphMLNode{ID: n.ID, Data: []graphMLData{
+			{"alias", n.Alias},
+			{"state", strconv.Itoa(n.State)},
+			{"state_name", n.StateName},
+			{"color", n.Color},
+		}})
+	}
+	for _, e := range t.Edges {
+		g.Graph.Edges = append(g.Graph.Edges, graphMLEdge{Source: e.Source, Target: e.Target})
+	}
+
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(g); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func getTopology(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "dot" && format != "graphml" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown format %q", format))
+		return
+	}
+
+	hosts, err := queryHosts("")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	t := buildTopology(hosts)
+
+	switch format {
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		writeDOT(w, t)
+	case "graphml":
+		w.Header().Set("Content-Type", "application/graphml+xml; charset=utf-8")
+		writeGraphML(w, t)
+	default:
+		writeJSON(w, r, t)
+	}
+}
+
+// hostsNamed returns the hosts with the given names.
+func hostsNamed(names []string) ([]Host, error) {
+	if len(names) == 0 {
+		return []Host{}, nil
+	}
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "Filter: name = %s\n", name)
+	}
+	if len(names) > 1 {
+		fmt.Fprintf(&b, "Or: %d\n", len(names))
+	}
+	hosts, err := queryHosts(b.String())
+	if hosts == nil && err == nil {
+		hosts = []Host{}
+	}
+	return hosts, err
+}
+
+func getHostParents(w http.ResponseWriter, r *http.Request) {
+	getRelatedHosts(w, r, func(h *Host) []string { return h.Parents })
+}
+
+func getHostChildren(w http.ResponseWriter, r *http.Request) {
+	getRelatedHosts(w, r, func(h *Host) []string { return h.Children })
+}
+
+// getRelatedHosts serves the hosts that related names for the host in the
+// request.
+func getRelatedHosts(w http.ResponseWriter, r *http.Request, related func(h *Host) []string) {
+	vars := mux.Vars(r)
+
+	host, err := findHost(vars["name"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if host == nil {
+		writeError(w, http.StatusNotFound, "Host not found")
+		return
+	}
+
+	hosts, err := hostsNamed(related(host))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, r, hosts)
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	// webhookLogSize is the number of deliveries kept for
+	// /webhooks/deliveries.
+	webhookLogSize = 1000
+	// webhookTimeout bounds each delivery attempt.
+	webhookTimeout = 10 * time.Second
+	// webhookMaxBackoff caps the exponential backoff between retries.
+	webhookMaxBackoff = 5 * time.Minute
+	// webhookWorkers is the number of deliveries made at a time, and
+	// webhookQueueSize how many more may wait before deliveries fail.
+	webhookWorkers   = 8
+	webhookQueueSize = 1000
+)
+
+// WebhookConfig is the file given with -webhooks.config.
+type WebhookConfig struct {
+	Webhooks []*Webhook `json:"webhooks"`
+}
+
+// Webhook is a URL that is sent state transitions matching its rule.
+type Webhook struct {
+	Name    string            `json:"name"`
+	URL     string            `json:"url"`
+	Rule    WebhookRule       `json:"rule"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Secret signs each payload with HMAC-SHA256 in the X-Signature-256
+	// header.
+	Secret string `json:"secret,omitempty"`
+	// Template renders the request body from a Transition with text/template.
+	// The default body is the Transition as JSON.
+	Template string `json:"template,omitempty"`
+	// MaxAttempts is how many times a delivery is tried, 5 by default.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// Backoff is the delay before the first retry, doubling after every
+	// failure, 1s by default.
+	Backoff string `json:"backoff,omitempty"`
+
+	tmpl    *template.Template
+	backoff time.Duration
+	filters []filterExpr
+}
+
+// WebhookRule selects the transitions sent to a webhook. Empty fields match
+// everything.
+type WebhookRule struct {
+	// Table is hosts or services.
+	Table      string   `json:"table,omitempty"`
+	HostGroups []string `json:"host_groups,omitempty"`
+	States     []int    `json:"states,omitempty"`
+	// StateType is hard or soft.
+	StateType    string `json:"state_type,omitempty"`
+	Acknowledged *bool  `json:"acknowledged,omitempty"`
+	// Filter uses the same expressions as the filter parameter of the
+	// collection endpoints and requires Table to be set.
+	Filter []string `json:"filter,omitempty"`
+}
+
+// Transition is a host or service state change found by comparing two
+// snapshots.
+type Transition struct {
+	Table              string    `json:"table"`
+	HostName           string    `json:"host_name"`
+	ServiceDescription string    `json:"service_description,omitempty"`
+	State              int       `json:"state"`
+	PreviousState      int       `json:"previous_state"`
+	StateType          string    `json:"state_type"`
+	Acknowledged       bool      `json:"acknowledged"`
+	HostGroups         []string  `json:"host_groups"`
+	Time               time.Time `json:"time"`
+	// Object is the host or service after the transition.
+	Object map[string]interface{} `json:"object"`
+}
+
+// WebhookDelivery records the delivery of one transition to one webhook.
+type WebhookDelivery struct {
+	ID         int        `json:"id"`
+	Webhook    string     `json:"webhook"`
+	Transition Transition `json:"transition"`
+	Attempts   int        `json:"attempts"`
+	// Status is pending, delivered or failed.
+	Status     string    `json:"status"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Created    time.Time `json:"created"`
+	Updated    time.Time `json:"updated"`
+}
+
+var webhooks struct {
+	config *WebhookConfig
+
+	mu         sync.Mutex
+	nextID     int
+	deliveries []*WebhookDelivery
+}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// webhookJob is a delivery attempt waiting for a worker.
+type webhookJob struct {
+	h *Webhook
+	d *WebhookDelivery
+	// attempt counts from 1, and backoff is the delay before the next one.
+	attempt int
+	backoff time.Duration
+}
+
+// webhookQueue holds the deliveries waiting for a worker.
+var webhookQueue = make(chan webhookJob, webhookQueueSize)
+
+// loadWebhooks reads and validates the webhook configuration file.
+func loadWebhooks(path string) (*WebhookConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c WebhookConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for _, h := range c.Webhooks {
+		if h.Name == "" || h.URL == "" {
+			return nil, fmt.Errorf("%s: webhooks need a name and url", path)
+		}
+		switch h.Rule.Table {
+		case "", "hosts", "services":
+		default:
+			return nil, fmt.Errorf("%s: webhook %s: table must be hosts or services", path, h.Name)
+		}
+		switch h.Rule.StateType {
+		case "", "hard", "soft":
+		default:
+			return nil, fmt.Errorf("%s: webhook %s: state_type must be hard or soft", path, h.Name)
+		}
+		if len(h.Rule.Filter) > 0 {
+			if h.Rule.Table == "" {
+				return nil, fmt.Errorf("%s: webhook %s: filter requires a table", path, h.Name)
+			}
+			if h.filters, err = parseFieldFilters(h.Rule.Table, h.Rule.Filter); err != nil {
+				return nil, fmt.Errorf("%s: webhook %s: %v", path, h.Name, err)
+			}
+		}
+		if h.Template != "" {
+			h.tmpl, err = template.New(h.Name).Funcs(template.FuncMap{"json": toJSON}).Parse(h.Template)
+			if err != nil {
+				return nil, fmt.Errorf("%s: webhook %s: %v", path, h.Name, err)
+			}
+		}
+		if h.MaxAttempts == 0 {
+			h.MaxAttempts = 5
+		}
+		h.backoff = time.Second
+		if h.Backoff != "" {
+			if h.backoff, err = time.ParseDuration(h.Backoff); err != nil {
+				return nil, fmt.Errorf("%s: webhook %s: %v", path, h.Name, err)
+			}
+		}
+	}
+	return &c, nil
+}
+
+// toJSON lets templates quote values, e.g. {"text": {{json .HostName}}}.
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// runWebhooks sends the transitions between successive snapshots to every
+// matching webhook. It never returns.
+func runWebhooks(c *WebhookConfig) {
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for job := range webhookQueue {
+				job.deliver()
+			}
+		}()
+	}
+
+	var last *snapshot
+	for s := range stateWatcher.subscribe() {
+		if last != nil {
+			for _, t := range transitions(last, s) {
+				for _, h := range c.Webhooks {
+					if h.matches(&t) {
+						h.enqueue(t)
+					}
+				}
+			}
+		}
+		last = s
+	}
+}
+
+// enqueue adds a pending delivery of t to the log and queues its first
+// attempt.
+func (h *Webhook) enqueue(t Transition) {
+	d := newDelivery(h.Name, t)
+	queueDelivery(webhookJob{h: h, d: d, attempt: 1, backoff: h.backoff})
+}
+
+// queueDelivery queues a delivery attempt. If the queue is full the delivery
+// fails straight away.
+func queueDelivery(job webhookJob) {
+	select {
+	case webhookQueue <- job:
+	default:
+		d := job.d
+		d.update(func() { d.Status, d.Error = "failed", "delivery queue full" })
+		log.Printf("webhook %s: delivery queue full, dropping delivery %d", job.h.Name, d.ID)
+	}
+}
+
+// transitions returns the hosts and services whose state or state type
+// differs between old and new.
+func transitions(old, new *snapshot) []Transition {
+	var out []Transition
+
+	hostGroups := make(map[string][]string, len(new.hosts))
+	for i := range new.hosts {
+		hostGroups[new.hosts[i].Name] = new.hosts[i].Groups
+	}
+	stateType := func(t int) string {
+		if t == 1 {
+			return "hard"
+		}
+		return "soft"
+	}
+
+	prevHosts := old.fields["hosts"]
+	for i := range new.hosts {
+		h := &new.hosts[i]
+		prev, ok := prevHosts[hostKey(h)]
+		if !ok || (int(prev["state"].(float64)) == h.State && int(prev["state_type"].(float64)) == h.StateType) {
+			continue
+		}
+		out = append(out, Transition{
+			Table:         "hosts",
+			HostName:      h.Name,
+			State:         h.State,
+			PreviousState: int(prev["state"].(float64)),
+			StateType:     stateType(h.StateType),
+			Acknowledged:  h.Acknowledged,
+			HostGroups:    h.Groups,
+			Time:          new.taken,
+			Object:        new.fields["hosts"][hostKey(h)],
+		})
+	}
+
+	prevServices := old.fields["services"]
+	for i := range new.services {
+		s := &new.services[i]
+		prev, ok := prevServices[serviceKey(s)]
+		if !ok || (int(prev["state"].(float64)) == s.State && int(prev["state_type"].(float64)) == s.StateType) {
+			continue
+		}
+		out = append(out, Transition{
+			Table:              "services",
+			HostName:           s.HostName,
+			ServiceDescription: s.Description,
+			State:              s.State,
+			PreviousState:      int(prev["state"].(float64)),
+			StateType:          stateType(s.StateType),
+			Acknowledged:       s.Acknowledged,
+			HostGroups:         hostGroups[s.HostName],
+			Time:               new.taken,
+			Object:             new.fields["services"][serviceKey(s)],
+		})
+	}
+	return out
+}
+
+// matches reports whether t passes h's rule.
+func (h *Webhook) matches(t *Transition) bool {
+	r := h.Rule
+	if r.Table != "" && r.Table != t.Table {
+		return false
+	}
+	if r.StateType != "" && r.StateType != t.StateType {
+		return false
+	}
+	if r.Acknowledged != nil && *r.Acknowledged != t.Acknowledged {
+		return false
+	}
+	if len(r.States) > 0 {
+		found := false
+		for _, s := range r.States {
+			found = found || s == t.State
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.HostGroups) > 0 {
+		found := false
+		for _, g := range t.HostGroups {
+			found = found || containsString(r.HostGroups, g)
+		}
+		if !found {
+			return false
+		}
+	}
+	return matchAll(h.filters, t.Object)
+}
+
+// payload renders the request body for t.
+func (h *Webhook) payload(t Transition) ([]byte, error) {
+	if h.tmpl == nil {
+		return json.Marshal(t)
+	}
+	var b bytes.Buffer
+	err := h.tmpl.Execute(&b, t)
+	return b.Bytes(), err
+}
+
+// deliver makes one attempt to post the job's transition and records the
+// outcome in the delivery log. Failed attempts are queued again after the
+// backoff, doubling it, so waiting for a retry does not hold up a worker.
+func (job webhookJob) deliver() {
+	h, d := job.h, job.d
+	body, err := h.payload(d.Transition)
+	if err != nil {
+		d.update(func() { d.Status, d.Error = "failed", err.Error() })
+		return
+	}
+
+	code, err := h.post(body, d.ID)
+	d.update(func() {
+		d.Attempts, d.StatusCode, d.Error = job.attempt, code, ""
+		if err != nil {
+			d.Error = err.Error()
+		}
+	})
+	if err == nil {
+		d.update(func() { d.Status = "delivered" })
+		return
+	}
+	if job.attempt >= h.MaxAttempts {
+		d.update(func() { d.Status = "failed" })
+		log.Printf("webhook %s: giving up after %d attempts: %v", h.Name, job.attempt, err)
+		return
+	}
+
+	next := job
+	next.attempt++
+	next.backoff = min(job.backoff*2, webhookMaxBackoff)
+	time.AfterFunc(job.backoff, func() { queueDelivery(next) })
+}
+
+// post makes one delivery attempt, returning the response status code.
+func (h *Webhook) post(body []byte, id int) (int, error) {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Delivery", fmt.Sprint(id))
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+	if h.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// newDelivery adds a pending delivery to the log.
+func newDelivery(webhook string, t Transition) *WebhookDelivery {
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+
+	webhooks.nextID++
+	d := &WebhookDelivery{
+		ID:         webhooks.nextID,
+		Webhook:    webhook,
+		Transition: t,
+		Status:     "pending",
+		Created:    time.Now(),
+		Updated:    time.Now(),
+	}
+	webhooks.deliveries = append(webhooks.deliveries, d)
+	if len(webhooks.deliveries) > webhookLogSize {
+		webhooks.deliveries = webhooks.deliveries[len(webhooks.deliveries)-webhookLogSize:]
+	}
+	return d
+}
+
+// update changes d while holding the delivery log lock.
+func (d *WebhookDelivery) update(f func()) {
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+	f()
+	d.Updated = time.Now()
+}
+
+func getWebhooks(w http.ResponseWriter, r *http.Request) {
+	// URLs and secrets are left out, since chat webhook URLs usually embed
+	// a token.
+	type webhook struct {
+		Name string      `json:"name"`
+		Rule WebhookRule `json:"rule"`
+	}
+	list := []webhook{}
+	if webhooks.config != nil {
+		for _, h := range webhooks.config.Webhooks {
+			list = append(list, webhook{h.Name, h.Rule})
+		}
+	}
+
+	writeJSON(w, r, list)
+}
+
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	// Copy the log so deliveries are not held up by slow clients.
+	webhooks.mu.Lock()
+	deliveries := make([]WebhookDelivery, len(webhooks.deliveries))
+	for i, d := range webhooks.deliveries {
+		deliveries[i] = *d
+	}
+	webhooks.mu.Unlock()
+
+	writeJSON(w, r, deliveries)
+}
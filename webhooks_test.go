@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// resetWebhooks empties the delivery log and gives the test a queue of size
+// n that no worker reads.
+func resetWebhooks(t *testing.T, n int) {
+	queue := webhookQueue
+	webhookQueue = make(chan webhookJob, n)
+	webhooks.mu.Lock()
+	webhooks.deliveries, webhooks.nextID = nil, 0
+	webhooks.mu.Unlock()
+	t.Cleanup(func() { webhookQueue = queue })
+}
+
+func TestWebhookDeliver(t *testing.T) {
+	resetWebhooks(t, 1)
+
+	var body []byte
+	var signature string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get("X-Signature-256")
+	}))
+	defer srv.Close()
+
+	h := &Webhook{Name: "ops", URL: srv.URL, Secret: "s3cret", MaxAttempts: 1}
+	h.enqueue(Transition{Table: "hosts", HostName: "web01", State: 1})
+	job := <-webhookQueue
+	job.deliver()
+
+	var got Transition
+	if err := json.Unmarshal(body, &got); err != nil || got.HostName != "web01" || got.State != 1 {
+		t.Errorf("body = %s (%v)", body, err)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != want {
+		t.Errorf("signature = %q, want %q", signature, want)
+	}
+	if job.d.Status != "delivered" || job.d.Attempts != 1 || job.d.StatusCode != http.StatusOK {
+		t.Errorf("delivery = %+v", *job.d)
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	resetWebhooks(t, 1)
+
+	h := &Webhook{Name: "ops", URL: "http://127.0.0.1:0/"}
+	h.enqueue(Transition{Table: "hosts", HostName: "web01"})
+	h.enqueue(Transition{Table: "hosts", HostName: "db01"})
+
+	rec := serve("GET", "/webhooks/deliveries", "")
+	var list []WebhookDelivery
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	if len(list) != 2 {
+		t.Fatalf("got %d deliveries", len(list))
+	}
+	if list[0].Status != "pending" {
+		t.Errorf("queued delivery is %s", list[0].Status)
+	}
+	if list[1].Status != "failed" || list[1].Error != "delivery queue full" {
+		t.Errorf("dropped delivery is %s: %s", list[1].Status, list[1].Error)
+	}
+}
+
+func TestWebhookRetryFreesWorker(t *testing.T) {
+	resetWebhooks(t, 100)
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	received := make(chan string, 1)
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("X-Webhook-Delivery")
+	}))
+	defer live.Close()
+
+	down := &Webhook{Name: "down", URL: dead.URL, MaxAttempts: 5, backoff: time.Hour}
+	up := &Webhook{Name: "up", URL: live.URL, MaxAttempts: 5, backoff: time.Hour}
+	for i := 0; i < 2*webhookWorkers; i++ {
+		down.enqueue(Transition{Table: "hosts", HostName: "web01"})
+	}
+	up.enqueue(Transition{Table: "hosts", HostName: "db01"})
+
+	// A single worker gets through every job, as failed ones wait for their
+	// retry outside it.
+	for len(webhookQueue) > 0 {
+		job := <-webhookQueue
+		job.deliver()
+	}
+	select {
+	case id := <-received:
+		if id != fmt.Sprint(2*webhookWorkers+1) {
+			t.Errorf("delivered %s", id)
+		}
+	default:
+		t.Fatal("the live webhook got nothing")
+	}
+
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+	for _, d := range webhooks.deliveries[:2*webhookWorkers] {
+		if d.Status != "pending" || d.Attempts != 1 {
+			t.Errorf("delivery %d to the dead webhook is %s after %d attempts", d.ID, d.Status, d.Attempts)
+		}
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	resetWebhooks(t, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	h := &Webhook{Name: "flaky", URL: srv.URL, MaxAttempts: 2, backoff: 10 * time.Millisecond}
+	h.enqueue(Transition{Table: "hosts", HostName: "web01"})
+	job := <-webhookQueue
+	job.deliver()
+
+	select {
+	case job = <-webhookQueue:
+	case <-time.After(time.Second):
+		t.Fatal("no retry queued")
+	}
+	if job.attempt != 2 || job.backoff != 20*time.Millisecond {
+		t.Errorf("retry is attempt %d with backoff %v", job.attempt, job.backoff)
+	}
+	job.deliver()
+	if job.d.Status != "failed" || job.d.Attempts != 2 || job.d.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("delivery = %+v", *job.d)
+	}
+}
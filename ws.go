@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsPingInterval is how often clients are pinged. A client that has not
+	// answered within wsPongTimeout is disconnected.
+	wsPingInterval = 30 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsWriteTimeout = 10 * time.Second
+	// wsSendBuffer is how many messages may be queued for a client before
+	// it is considered too slow and disconnected.
+	wsSendBuffer = 256
+)
+
+var upgrader = websocket.Upgrader{CheckOrigin: checkOrigin}
+
+// checkOrigin allows websockets from pages served by the API's own host and
+// from -ws.allowed-origins. Browsers resend cached basic auth credentials to
+// any page's websockets, so others could read live state. Clients that are
+// not browsers send no Origin and are allowed.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range strings.Split(*wsAllowedOrigins, ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsRequest is a message sent by a websocket client.
+type wsRequest struct {
+	// Type is subscribe or unsubscribe.
+	Type string `json:"type"`
+	// ID names the subscription in later messages.
+	ID string `json:"id"`
+	// Table is hosts or services.
+	Table string `json:"table"`
+	// Filter uses the same expressions as the filter parameter of the
+	// collection endpoints.
+	Filter []string `json:"filter"`
+	// Fields limits objects and patches to these JSON fields.
+	Fields []string `json:"fields"`
+}
+
+// wsMessage is a message sent to a websocket client.
+type wsMessage struct {
+	// Type is snapshot, add, patch, remove or error.
+	Type         string                            `json:"type"`
+	Subscription string                            `json:"subscription,omitempty"`
+	Key          string                            `json:"key,omitempty"`
+	Objects      map[string]map[string]interface{} `json:"objects,omitempty"`
+	Object       map[string]interface{}            `json:"object,omitempty"`
+	Patch        []jsonPatchOp                     `json:"patch,omitempty"`
+	Message      string                            `json:"message,omitempty"`
+}
+
+// jsonPatchOp is an RFC 6902 JSON Patch operation.
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// MarshalJSON leaves the value out of remove operations, which have none,
+// while add and replace keep theirs even if it is null.
+func (op jsonPatchOp) MarshalJSON() ([]byte, error) {
+	if op.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{op.Op, op.Path})
+	}
+	type plain jsonPatchOp
+	return json.Marshal(plain(op))
+}
+
+type wsSubscription struct {
+	id      string
+	table   string
+	filters []filterExpr
+	fields  []string
+	// sent is false until the subscription's first snapshot is sent.
+	sent bool
+}
+
+// wsClient is one websocket connection and its subscriptions.
+type wsClient struct {
+	conn *websocket.Conn
+	send chan wsMessage
+	done chan struct{}
+	once sync.Once
+
+	mu   sync.Mutex
+	subs map[string]*wsSubscription
+	// last is the snapshot the client's subscriptions are up to date with.
+	last *snapshot
+}
+
+func getWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied to the client.
+		return
+	}
+
+	c := &wsClient{
+		conn: conn,
+		send: make(chan wsMessage, wsSendBuffer),
+		done: make(chan struct{}),
+		subs: make(map[string]*wsSubscription),
+	}
+	snapshots := stateWatcher.subscribe()
+	defer stateWatcher.unsubscribe(snapshots)
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case s := <-snapshots:
+			c.mu.Lock()
+			for _, sub := range c.subs {
+				c.update(sub, c.last, s)
+			}
+			c.last = s
+			c.mu.Unlock()
+		}
+	}
+}
+
+// close disconnects the client, optionally telling it why.
+func (c *wsClient) close(code int, reason string) {
+	c.once.Do(func() {
+		if code != 0 {
+			msg := websocket.FormatCloseMessage(code, reason)
+			c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteTimeout))
+		}
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// enqueue queues m for the client, disconnecting clients that do not keep up
+// rather than buffering without bound.
+func (c *wsClient) enqueue(m wsMessage) {
+	select {
+	case c.send <- m:
+	default:
+		go c.close(websocket.CloseTryAgainLater, "client too slow")
+	}
+}
+
+func (c *wsClient) writeLoop() {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case m := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := c.conn.WriteJSON(m); err != nil {
+				c.close(0, "")
+				return
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				c.close(0, "")
+				return
+			}
+		}
+	}
+}
+
+func (c *wsClient) readLoop() {
+	c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		var req wsRequest
+		if err := c.conn.ReadJSON(&req); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				c.enqueue(wsMessage{Type: "error", Message: err.Error()})
+				continue
+			}
+			c.close(0, "")
+			return
+		}
+		c.handle(req)
+	}
+}
+
+// handle processes a subscribe or unsubscribe request.
+func (c *wsClient) handle(req wsRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch req.Type {
+	case "subscribe":
+		if req.ID == "" {
+			c.enqueue(wsMessage{Type: "error", Message: "subscribe requires an id"})
+			return
+		}
+		if req.Table != "hosts" && req.Table != "services" {
+			c.enqueue(wsMessage{Type: "error", Subscription: req.ID, Message: "table must be hosts or services"})
+			return
+		}
+		filters, err := parseFieldFilters(req.Table, req.Filter)
+		if err != nil {
+			c.enqueue(wsMessage{Type: "error", Subscription: req.ID, Message: err.Error()})
+			return
+		}
+
+		sub := &wsSubscription{id: req.ID, table: req.Table, filters: filters, fields: req.Fields}
+		c.subs[req.ID] = sub
+		// Before the client's first snapshot arrives, this is left to the
+		// loop in getWebsocket.
+		if c.last != nil {
+			c.update(sub, nil, c.last)
+		}
+	case "unsubscribe":
+		delete(c.subs, req.ID)
+	default:
+		c.enqueue(wsMessage{Type: "error", Subscription: req.ID, Message: "unknown message type " + req.Type})
+	}
+}
+
+// update sends sub the changes between old and new. Subscriptions that have
+// not been sent anything yet get a snapshot of new instead.
+func (c *wsClient) update(sub *wsSubscription, old, new *snapshot) {
+	objs := new.fields[sub.table]
+
+	if !sub.sent {
+		m := wsMessage{Type: "snapshot", Subscription: sub.id, Objects: map[string]map[string]interface{}{}}
+		for key, fields := range objs {
+			if matchAll(sub.filters, fields) {
+				m.Objects[key] = onlyFields(fields, sub.fields)
+			}
+		}
+		sub.sent = true
+		c.enqueue(m)
+		return
+	}
+
+	prev := old.fields[sub.table]
+	for key, fields := range objs {
+		if !matchAll(sub.filters, fields) {
+			continue
+		}
+		before, ok := prev[key]
+		if !ok || !matchAll(sub.filters, before) {
+			c.enqueue(wsMessage{Type: "add", Subscription: sub.id, Key: key, Object: onlyFields(fields, sub.fields)})
+			continue
+		}
+
+		changes := changedFields(before, fields, sub.fields)
+		if len(changes) == 0 {
+			continue
+		}
+		m := wsMessage{Type: "patch", Subscription: sub.id, Key: key}
+		for _, ch := range changes {
+			m.Patch = append(m.Patch, jsonPatchOp{Op: ch.op, Path: jsonPointer(ch.field), Value: ch.new})
+		}
+		c.enqueue(m)
+	}
+	for key, before := range prev {
+		if !matchAll(sub.filters, before) {
+			continue
+		}
+		if fields, ok := objs[key]; !ok || !matchAll(sub.filters, fields) {
+			c.enqueue(wsMessage{Type: "remove", Subscription: sub.id, Key: key})
+		}
+	}
+}
+
+// onlyFields returns the subset of fields named in only, or all of them if
+// only is empty.
+func onlyFields(fields map[string]interface{}, only []string) map[string]interface{} {
+	if len(only) == 0 {
+		return fields
+	}
+	out := make(map[string]interface{}, len(only))
+	for _, f := range only {
+		if v, ok := fields[f]; ok {
+			out[f] = v
+		}
+	}
+	return out
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebsocketPatchOps(t *testing.T) {
+	c := &wsClient{send: make(chan wsMessage, 10)}
+	sub := &wsSubscription{id: "web", table: "hosts", sent: true}
+	old := &snapshot{fields: map[string]map[string]map[string]interface{}{
+		"hosts": {"web01": {"name": "web01", "state": 0.0, "notes": "racked"}},
+	}}
+	new := &snapshot{fields: map[string]map[string]map[string]interface{}{
+		"hosts": {"web01": {"name": "web01", "state": 1.0, "acknowledged": nil}},
+	}}
+	c.update(sub, old, new)
+
+	m := <-c.send
+	b, err := json.Marshal(m.Patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"op":"add","path":"/acknowledged","value":null},{"op":"remove","path":"/notes"},{"op":"replace","path":"/state","value":1}]`
+	if string(b) != want {
+		t.Errorf("patch = %s, want %s", b, want)
+	}
+}
+
+func TestWebsocketPatchOpsFields(t *testing.T) {
+	c := &wsClient{send: make(chan wsMessage, 10)}
+	sub := &wsSubscription{id: "web", table: "hosts", fields: []string{"notes"}, sent: true}
+	old := &snapshot{fields: map[string]map[string]map[string]interface{}{
+		"hosts": {"web01": {"state": 0.0}},
+	}}
+	new := &snapshot{fields: map[string]map[string]map[string]interface{}{
+		"hosts": {"web01": {"state": 1.0, "notes": "racked"}},
+	}}
+	c.update(sub, old, new)
+
+	m := <-c.send
+	if len(m.Patch) != 1 || m.Patch[0].Op != "add" || m.Patch[0].Path != "/notes" {
+		t.Errorf("patch = %+v", m.Patch)
+	}
+}
+
+func TestWebsocketOrigin(t *testing.T) {
+	defer func(v string) { *wsAllowedOrigins = v }(*wsAllowedOrigins)
+	*wsAllowedOrigins = "https://dashboard.example.com, https://ops.example.com"
+
+	for _, tc := range []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},
+		{"http://api.example.com:7654", true},
+		{"https://dashboard.example.com", true},
+		{"https://OPS.example.com", true},
+		{"https://evil.example.com", false},
+		{"http://api.example.com", false},
+		{"null", false},
+	} {
+		r := httptest.NewRequest("GET", "http://api.example.com:7654/ws", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if ok := checkOrigin(r); ok != tc.ok {
+			t.Errorf("Origin %q allowed = %v, want %v", tc.origin, ok, tc.ok)
+		}
+	}
+}